@@ -22,6 +22,7 @@ import (
 	"os"
 
 	"github.com/majst01/csi-driver-s3/pkg/s3"
+	"k8s.io/klog/v2"
 )
 
 func init() {
@@ -31,18 +32,117 @@ func init() {
 	}
 }
 
+var defaults = s3.DefaultDriverConfig()
+
 var (
-	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	nodeID   = flag.String("nodeid", "", "node id")
+	configFile = flag.String("config", "", "YAML or JSON file with the configuration of the driver, overridden by CSI_S3_ environment variables and flags")
+
+	endpoint  = flag.String("endpoint", defaults.Endpoint, "CSI endpoint")
+	nodeID    = flag.String("nodeid", "", "node id")
+	clusterID = flag.String("cluster-id", "", "id of the cluster, set as tag on all created buckets")
+	mode      = flag.String("mode", defaults.Mode, "services to serve: controller, node or all")
+
+	clientCacheTTL      = flag.Duration("client-cache-ttl", defaults.ClientCache.TTL, "time an unused S3 client is kept for reuse")
+	maxIdleConns        = flag.Int("max-idle-conns", defaults.ClientCache.MaxIdleConns, "maximum number of idle connections to all S3 endpoints with the same TLS settings")
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", defaults.ClientCache.MaxIdleConnsPerHost, "maximum number of idle connections to a single S3 endpoint")
+
+	metadataStore     = flag.String("metadata-store", defaults.MetadataStore.Type, "where the metadata of volumes is stored: object, bucket-tags or kubernetes")
+	metadataNamespace = flag.String("metadata-namespace", "", "namespace of the secrets of the kubernetes metadata store, defaults to the namespace of the driver")
+
+	metricsAddress = flag.String("metrics-address", "", "host:port of the prometheus metrics, metrics are not served if empty")
+	logFormat      = flag.String("log-format", defaults.LogFormat, "format of the logs: text or json")
+	probeEndpoint  = flag.String("probe-endpoint", "", "URL of an S3 endpoint which must be reachable for the probe of the controller to succeed")
+	stateDir       = flag.String("state-dir", "", "directory on the host for the files of the mounts of a node, defaults to a directory below the temporary directory")
+
+	topologySegments   = flag.String("topology-segments", "", "topology of the node as comma separated key=value pairs, e.g. topology.kubernetes.io/zone=dc1")
+	topologyNodeLabels = flag.String("topology-node-labels", "", "comma separated keys of labels of the node which are reported as its topology")
+
+	tracingEndpoint    = flag.String("tracing-endpoint", "", "host:port of the OpenTelemetry collector receiving traces over OTLP/gRPC, traces are not exported if empty")
+	tracingInsecure    = flag.Bool("tracing-insecure", false, "connect to the OpenTelemetry collector without TLS")
+	tracingSampleRatio = flag.Float64("tracing-sample-ratio", defaults.Tracing.SampleRatio, "fraction of the CSI calls without a sampled parent which are traced")
+
+	reaperInterval        = flag.Duration("reaper-interval", 0, "time between removals of ephemeral volumes whose PV does not exist anymore, disabled if 0")
+	reaperSecretName      = flag.String("reaper-secret-name", "", "secret with the S3 credentials the reaper lists and removes ephemeral buckets with")
+	reaperSecretNamespace = flag.String("reaper-secret-namespace", "", "namespace of the secret of the reaper, defaults to the namespace of the driver")
 )
 
 func main() {
 	flag.Parse()
 
-	driver, err := s3.New(*nodeID, *endpoint)
+	// glog of csi-common owns the flags of klog, the driver logs with klog at the verbosity given with -v
+	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
+	klog.InitFlags(klogFlags)
+	if v := flag.Lookup("v"); v != nil {
+		if err := klogFlags.Set("v", v.Value.String()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cfg, err := s3.LoadDriverConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	driver.Run()
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	// only flags given on the command line override the file and the environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "endpoint":
+			cfg.Endpoint = *endpoint
+		case "nodeid":
+			cfg.NodeID = *nodeID
+		case "cluster-id":
+			cfg.ClusterID = *clusterID
+		case "mode":
+			cfg.Mode = *mode
+		case "client-cache-ttl":
+			cfg.ClientCache.TTL = *clientCacheTTL
+		case "max-idle-conns":
+			cfg.ClientCache.MaxIdleConns = *maxIdleConns
+		case "max-idle-conns-per-host":
+			cfg.ClientCache.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+		case "metadata-store":
+			cfg.MetadataStore.Type = *metadataStore
+		case "metadata-namespace":
+			cfg.MetadataStore.Namespace = *metadataNamespace
+		case "metrics-address":
+			cfg.MetricsAddress = *metricsAddress
+		case "log-format":
+			cfg.LogFormat = *logFormat
+		case "probe-endpoint":
+			cfg.ProbeEndpoint = *probeEndpoint
+		case "state-dir":
+			cfg.StateDir = *stateDir
+		case "topology-segments":
+			segments, err := s3.ParseSegments(*topologySegments)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Topology.Segments = segments
+		case "topology-node-labels":
+			cfg.Topology.NodeLabels = s3.ParseList(*topologyNodeLabels)
+		case "tracing-endpoint":
+			cfg.Tracing.Endpoint = *tracingEndpoint
+		case "tracing-insecure":
+			cfg.Tracing.Insecure = *tracingInsecure
+		case "tracing-sample-ratio":
+			cfg.Tracing.SampleRatio = *tracingSampleRatio
+		case "reaper-interval":
+			cfg.Reaper.Interval = *reaperInterval
+		case "reaper-secret-name":
+			cfg.Reaper.SecretName = *reaperSecretName
+		case "reaper-secret-namespace":
+			cfg.Reaper.SecretNamespace = *reaperSecretNamespace
+		}
+	})
+
+	driver, err := s3.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := driver.Run(); err != nil {
+		log.Fatal(err)
+	}
 	os.Exit(0)
 }
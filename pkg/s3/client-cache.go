@@ -0,0 +1,177 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ClientCacheOptions configure the reuse of S3 clients and their connections across CSI calls
+type ClientCacheOptions struct {
+	// TTL is the time an unused client is kept
+	TTL time.Duration `json:"ttl,omitempty"`
+	// MaxIdleConns and MaxIdleConnsPerHost limit the connection pool of every transport
+	MaxIdleConns        int `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+}
+
+// UnmarshalJSON reads the TTL as duration like 10m
+func (o *ClientCacheOptions) UnmarshalJSON(b []byte) error {
+	type options ClientCacheOptions
+	aux := struct {
+		TTL string `json:"ttl,omitempty"`
+		*options
+	}{options: (*options)(o)}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+	if aux.TTL != "" {
+		ttl, err := time.ParseDuration(aux.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %w", err)
+		}
+		o.TTL = ttl
+	}
+	return nil
+}
+
+// DefaultClientCacheOptions are used for all options which are not set
+var DefaultClientCacheOptions = ClientCacheOptions{
+	TTL:                 10 * time.Minute,
+	MaxIdleConns:        256,
+	MaxIdleConnsPerHost: 16,
+}
+
+// clientCache reuses clients for the same secret, so connections and the discovered bucket regions are kept.
+// Clients are identified by a hash of their configuration, a changed secret results in a new client.
+type clientCache struct {
+	opts ClientCacheOptions
+	now  func() time.Time
+
+	lock    sync.Mutex
+	clients map[string]*cachedClient
+
+	transportLock sync.Mutex
+	// transports are shared by all clients with the same TLS and proxy settings
+	transports map[string]*http.Transport
+}
+
+type cachedClient struct {
+	client *s3Client
+	// identity is the endpoint, region and principal of the secret
+	identity string
+	lastUsed time.Time
+}
+
+func newClientCache(opts ClientCacheOptions) *clientCache {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultClientCacheOptions.TTL
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultClientCacheOptions.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost <= 0 {
+		opts.MaxIdleConnsPerHost = DefaultClientCacheOptions.MaxIdleConnsPerHost
+	}
+	return &clientCache{
+		opts:       opts,
+		now:        time.Now,
+		clients:    map[string]*cachedClient{},
+		transports: map[string]*http.Transport{},
+	}
+}
+
+// get returns the client for the secret of a CSI call
+func (c *clientCache) get(secrets map[string]string) (*s3Client, error) {
+	cfg, err := configFromSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	key := hashJSON(cfg)
+	identity := cfg.Endpoint + "|" + cfg.Region + "|" + cfg.AccessKeyID + "|" + cfg.RoleARN
+
+	c.lock.Lock()
+	now := c.now()
+	c.evictExpired(now)
+	if cached, ok := c.clients[key]; ok {
+		cached.lastUsed = now
+		c.lock.Unlock()
+		return cached.client, nil
+	}
+	c.lock.Unlock()
+
+	// clients are created without the lock, they might request credentials from an STS
+	client, err := newS3Client(cfg, c.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached, ok := c.clients[key]; ok {
+		// created concurrently by another call
+		cached.lastUsed = now
+		return cached.client, nil
+	}
+	for k, cached := range c.clients {
+		if cached.identity == identity {
+			klog.InfoS("Secret changed, evicting cached client", "endpoint", cfg.Endpoint)
+			delete(c.clients, k)
+		}
+	}
+	c.clients[key] = &cachedClient{
+		client:   client,
+		identity: identity,
+		lastUsed: now,
+	}
+	return client, nil
+}
+
+// evictExpired must be called with the lock held
+func (c *clientCache) evictExpired(now time.Time) {
+	for k, cached := range c.clients {
+		if now.Sub(cached.lastUsed) > c.opts.TTL {
+			delete(c.clients, k)
+		}
+	}
+}
+
+// transport returns the shared transport for the TLS and proxy settings of cfg
+func (c *clientCache) transport(cfg *Config, secure bool) (*http.Transport, error) {
+	key := hashJSON(struct {
+		Secure             bool
+		CABundle           string
+		ClientCert         string
+		ClientKey          string
+		InsecureSkipVerify bool
+		HTTPProxy          string
+	}{
+		Secure:             secure,
+		CABundle:           cfg.CABundle,
+		ClientCert:         cfg.ClientCert,
+		ClientKey:          cfg.ClientKey,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		HTTPProxy:          cfg.HTTPProxy,
+	})
+
+	c.transportLock.Lock()
+	defer c.transportLock.Unlock()
+	if t, ok := c.transports[key]; ok {
+		return t, nil
+	}
+	t, err := newTransport(cfg, secure)
+	if err != nil {
+		return nil, err
+	}
+	t.MaxIdleConns = c.opts.MaxIdleConns
+	t.MaxIdleConnsPerHost = c.opts.MaxIdleConnsPerHost
+	c.transports[key] = t
+	return t, nil
+}
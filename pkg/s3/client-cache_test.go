@@ -0,0 +1,61 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_clientCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newClientCache(ClientCacheOptions{TTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	secrets := map[string]string{
+		"endpoint":        "http://minio.example.com:9000",
+		"accessKeyID":     "key",
+		"secretAccessKey": "secret",
+	}
+	first, err := cache.get(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.get(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("get() created a new client for the same secret")
+	}
+
+	rotated := map[string]string{
+		"endpoint":        "http://minio.example.com:9000",
+		"accessKeyID":     "key",
+		"secretAccessKey": "rotated",
+	}
+	third, err := cache.get(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Error("get() returned the client of the old secret")
+	}
+	if len(cache.clients) != 1 {
+		t.Errorf("get() did not evict the client of the old secret, %d clients cached", len(cache.clients))
+	}
+	if third.transport != first.transport {
+		t.Error("get() did not share the transport of clients with the same TLS settings")
+	}
+
+	now = now.Add(2 * time.Minute)
+	fourth, err := cache.get(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth == third {
+		t.Error("get() returned an expired client")
+	}
+
+	if _, err := cache.get(map[string]string{"endpoint": "minio.example.com"}); err == nil {
+		t.Error("get() expected error for invalid endpoint")
+	}
+}
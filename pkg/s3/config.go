@@ -1,10 +1,45 @@
 package s3
 
+import "time"
+
 // Config holds values to configure the driver
 type Config struct {
 	AccessKeyID     string
 	SecretAccessKey string
-	Region          string
-	Endpoint        string
-	Mounter         string
+	// SessionToken is set for temporary credentials
+	SessionToken string
+	Region       string
+	// Endpoint is the URL of the S3 API, the AWS endpoint of the region if empty
+	Endpoint string
+	// UseFIPS and UseDualStack select the AWS endpoint if no endpoint is given
+	UseFIPS      bool
+	UseDualStack bool
+	Mounter      string
+	// SSECustomerKey is the base64 encoded key used for sse-c encryption
+	SSECustomerKey string
+	// EncryptionPassphrase is the key of volumes encrypted on the client
+	EncryptionPassphrase string
+	// ScopedCredentialsKey derives the secret keys of scoped credentials, it must be the same for controller and nodes
+	ScopedCredentialsKey string
+	// CredentialsChain is the ordered list of providers to get credentials from
+	CredentialsChain []string
+	// WebIdentityTokenFile, RoleARN and STSEndpoint configure AssumeRoleWithWebIdentity
+	WebIdentityTokenFile string
+	RoleARN              string
+	STSEndpoint          string
+	// CABundle, ClientCert and ClientKey are PEM encoded
+	CABundle   string
+	ClientCert string
+	ClientKey  string
+	// InsecureSkipVerify disables the verification of the endpoint certificate
+	InsecureSkipVerify bool
+	// AddressingStyle is auto, path or virtual
+	AddressingStyle string
+	// SignatureVersion is v2 or v4
+	SignatureVersion string
+	// HTTPProxy is the URL of the proxy for all requests to the endpoint
+	HTTPProxy string
+	// OperationTimeout limits every attempt of an S3 operation, MaxRetries is the number of retries after transient errors
+	OperationTimeout time.Duration
+	MaxRetries       int
 }
@@ -19,9 +19,12 @@ package s3
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -29,11 +32,27 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/metal-stack/v"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	clusterID string
+	// driverName and metadataName describe the scoped credentials of new volumes
+	driverName   string
+	metadataName string
+	clients      *clientCache
+	// volumeLocks serializes the operations of a volume
+	volumeLocks *volumeLocks
+	metadata    metadataStore
+	// fsPrefix, defaultMounter and defaultParameters are applied to new volumes
+	fsPrefix          string
+	defaultMounter    string
+	defaultParameters map[string]string
+	// sites are the S3 endpoints new volumes are created at depending on their accessibility requirements
+	sites []TopologySite
 }
 
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
@@ -44,7 +63,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	volumeID := req.GetName()
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		klog.Infof("invalid create volume req: %v", req)
+		klog.FromContext(ctx).Info("Invalid create volume request", "request", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
 
@@ -58,20 +77,61 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	capacityBytes := int64(req.GetCapacityRange().GetRequiredBytes())
 
-	klog.Infof("Got a request to create volume %s", volumeID)
+	params := withDefaults(req.GetParameters(), cs.defaultParameters)
+	opts, err := parseBucketOptions(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters:%v", err)
+	}
+	if err := checkEphemeral(req.GetParameters(), opts.Ephemeral); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters:%v", err)
+	}
+	if opts.EncryptionKeySecret != nil {
+		if opts.EncryptionKeySecret, err = opts.EncryptionKeySecret.resolve(params); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid parameters:%v", err)
+		}
+	}
+	if opts.Tags, err = bucketTags(params, cs.clusterID, v.Version, opts.Ephemeral); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters:%v", err)
+	}
+	opts.FSPath = cs.fsPrefix
+	if opts.Mounter == "" {
+		opts.Mounter = cs.defaultMounter
+	}
+	secrets := req.GetSecrets()
+	var site *TopologySite
+	if len(cs.sites) > 0 {
+		site, err = selectSite(cs.sites, req.GetAccessibilityRequirements())
+		if err != nil {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		secrets = site.secrets(secrets)
+	}
 
-	err := ensureBucketWithMetadata(volumeID, req.GetSecrets(), capacityBytes)
+	if !cs.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
+	}
+	defer cs.volumeLocks.release(volumeID)
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Creating volume")
+
+	err = cs.ensureBucketWithMetadata(ctx, volumeID, secrets, capacityBytes, opts)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot create backup and metadata:%v", err)
-	}
-	klog.Infof("create volume %s", volumeID)
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: req.GetParameters(),
-		},
-	}, nil
+		return nil, statusError(err, "cannot create bucket and metadata")
+	}
+	volume := &csi.Volume{
+		VolumeId:      volumeID,
+		CapacityBytes: capacityBytes,
+		VolumeContext: opts.volumeContext(params),
+	}
+	if site != nil {
+		site.volumeContext(volume.VolumeContext)
+		volume.AccessibleTopology = []*csi.Topology{{Segments: site.Segments}}
+		logger.Info("Volume created", "site", site.Name)
+	} else {
+		logger.Info("Volume created")
+	}
+	return &csi.CreateVolumeResponse{Volume: volume}, nil
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -83,26 +143,33 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		klog.Errorf("Invalid delete volume req: %v", req)
+		klog.FromContext(ctx).Error(err, "Invalid delete volume request", "request", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
-	klog.Infof("Deleting volume %s", volumeID)
-
-	s3, err := newS3ClientFromSecrets(req.GetSecrets())
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
+	if !cs.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
 	}
-	exists, err := s3.bucketExists(volumeID)
+	defer cs.volumeLocks.release(volumeID)
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Deleting volume")
+
+	s3, exists, err := cs.locateVolume(ctx, req.GetSecrets(), volumeID)
 	if err != nil {
 		return nil, err
 	}
 	if exists {
-		if err := s3.removeBucket(volumeID); err != nil {
-			klog.Errorf("Failed to remove volume %s: %w", volumeID, err)
-			return nil, err
+		if err := cs.removeVolume(ctx, s3, volumeID); err != nil {
+			logger.Error(err, "Failed to remove the volume")
+			return nil, statusError(err, "failed to remove volume %s", volumeID)
 		}
 	} else {
-		klog.Infof("Bucket %s does not exist, ignoring request", volumeID)
+		// metadata stored outside of the bucket might be left over by older drivers
+		if err := cs.metadata.remove(ctx, s3, volumeID); err != nil {
+			logger.Error(err, "Failed to remove the metadata of the missing bucket")
+			return nil, statusError(err, "failed to remove metadata of volume %s", volumeID)
+		}
+		logger.Info("Bucket does not exist, ignoring request")
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -118,11 +185,7 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 
-	s3, err := newS3ClientFromSecrets(req.GetSecrets())
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
-	}
-	exists, err := s3.bucketExists(req.GetVolumeId())
+	_, exists, err := cs.locateVolume(ctx, req.GetSecrets(), req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
@@ -153,6 +216,51 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// locateVolume returns the client of the site the bucket of the volume exists at.
+// Volumes created before sites were configured are at the endpoint of the secret.
+func (cs *controllerServer) locateVolume(ctx context.Context, secrets map[string]string, volumeID string) (*s3Client, bool, error) {
+	var client *s3Client
+	for _, candidate := range cs.siteSecrets(secrets) {
+		var err error
+		client, err = cs.clients.get(candidate)
+		if err != nil {
+			return nil, false, status.Errorf(codes.InvalidArgument, "failed to initialize S3 client: %v", err)
+		}
+		exists, err := client.bucketExists(ctx, volumeID)
+		if err != nil {
+			return nil, false, statusError(err, "failed to check if bucket %s exists", volumeID)
+		}
+		if exists {
+			return client, true, nil
+		}
+	}
+	return client, false, nil
+}
+
+// siteSecrets returns the secrets of all sites volumes might exist at
+func (cs *controllerServer) siteSecrets(secrets map[string]string) []map[string]string {
+	candidates := make([]map[string]string, 0, len(cs.sites)+1)
+	for i := range cs.sites {
+		candidates = append(candidates, cs.sites[i].secrets(secrets))
+	}
+	if len(cs.sites) == 0 || secrets["endpoint"] != "" || secrets["region"] != "" {
+		candidates = append(candidates, secrets)
+	}
+	return candidates
+}
+
+// removeVolume revokes the scoped credentials and removes the metadata and the bucket of a volume,
+// the bucket goes last so a failed attempt is repeated by the next DeleteVolume
+func (cs *controllerServer) removeVolume(ctx context.Context, s3 *s3Client, volumeID string) error {
+	if err := cs.revokeScopedCredentials(ctx, s3, volumeID); err != nil {
+		return fmt.Errorf("failed to revoke credentials: %w", err)
+	}
+	if err := cs.metadata.remove(ctx, s3, volumeID); err != nil {
+		return fmt.Errorf("failed to remove metadata: %w", err)
+	}
+	return s3.removeBucket(ctx, volumeID)
+}
+
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerExpandVolume is not implemented")
 }
@@ -167,28 +275,30 @@ func sanitizeVolumeID(volumeID string) string {
 	return volumeID
 }
 
-func ensureBucketWithMetadata(volumeID string, secrets map[string]string, capacityBytes int64) error {
-	s3, err := newS3ClientFromSecrets(secrets)
+func (cs *controllerServer) ensureBucketWithMetadata(ctx context.Context, volumeID string, secrets map[string]string, capacityBytes int64, opts *bucketOptions) error {
+	s3, err := cs.clients.get(secrets)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to initialize S3 client: %v", err)
+	}
+	if opts.ScopedCredentials != "" && s3.cfg.ScopedCredentialsKey == "" {
+		return status.Error(codes.InvalidArgument, "scoped credentials require scopedCredentialsKey in secret")
+	}
+	serverSide, err := opts.SSE.serverSide(s3.cfg)
 	if err != nil {
-		return fmt.Errorf("failed to initialize S3 client: %w", err)
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
-	exists, err := s3.bucketExists(volumeID)
+	exists, err := s3.bucketExists(ctx, volumeID)
 	if err != nil {
 		return fmt.Errorf("failed to check if bucket %s exists: %w", volumeID, err)
 	}
+	metadataExists := false
 	if exists {
-		var meta *metadata
-		if !s3.metadataExist(volumeID) {
-			b := &metadata{
-				Name:          volumeID,
-				CapacityBytes: capacityBytes,
-				FSPath:        fsPrefix,
-			}
-			if err := s3.writeMetadata(b); err != nil {
-				return fmt.Errorf("Error setting volume metadata: %w", err)
-			}
+		if metadataExists, err = cs.metadata.exists(ctx, s3, volumeID); err != nil {
+			return fmt.Errorf("failed to check if metadata of volume %s exists: %w", volumeID, err)
 		}
-		meta, err = s3.getMetadata(volumeID)
+	}
+	if metadataExists {
+		meta, err := cs.metadata.get(ctx, s3, volumeID)
 		if err != nil {
 			return fmt.Errorf("failed to get metadata of volume %s: %w", volumeID, err)
 		}
@@ -196,21 +306,94 @@ func ensureBucketWithMetadata(volumeID string, secrets map[string]string, capaci
 		if capacityBytes > meta.CapacityBytes {
 			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with smaller size already exist", volumeID))
 		}
-	} else {
-		if err = s3.createBucket(volumeID); err != nil {
-			return fmt.Errorf("failed to create bucket for volume %s: %w", volumeID, err)
+		if !meta.SSE.equal(opts.SSE) {
+			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different encryption already exist", volumeID))
 		}
-		if err = s3.createPrefix(volumeID, fsPrefix); err != nil {
-			return fmt.Errorf("failed to create prefix %s for volume %s: %w", fsPrefix, volumeID, err)
+		if meta.ClientEncryption != opts.ClientEncryption {
+			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different client-side encryption already exist", volumeID))
 		}
-		meta := &metadata{
-			Name:          volumeID,
-			CapacityBytes: capacityBytes,
-			FSPath:        fsPrefix,
+		if !reflect.DeepEqual(meta.EncryptionKeySecret, opts.EncryptionKeySecret) {
+			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different encryption key secret already exist", volumeID))
 		}
-		if err := s3.writeMetadata(meta); err != nil {
-			return fmt.Errorf("Error setting volume metadata: %w", err)
+		// the options are unknown for metadata of version 1
+		if meta.Options != nil && !reflect.DeepEqual(meta.Options, newVolumeOptions(opts)) {
+			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different versioning, object lock or lifecycle already exist", volumeID))
+		}
+		if meta.Ephemeral != opts.Ephemeral {
+			return status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different ephemeral parameter already exist", volumeID))
+		}
+		if err := s3.validateBucketEncryption(ctx, volumeID, opts.SSE); err != nil {
+			return fmt.Errorf("encryption of volume %s was not accepted by the backend: %w", volumeID, err)
+		}
+		return nil
+	}
+
+	// The metadata is written last, a bucket without metadata is left over from a failed attempt.
+	// createBucket applies the whole configuration again, it is idempotent.
+	if err = s3.createBucket(ctx, volumeID, opts); err != nil {
+		return fmt.Errorf("failed to create bucket for volume %s: %w", volumeID, err)
+	}
+	if err = s3.createPrefix(ctx, volumeID, opts.FSPath, serverSide); err != nil {
+		return fmt.Errorf("failed to create prefix %s for volume %s: %w", opts.FSPath, volumeID, err)
+	}
+	if err := s3.validateBucketEncryption(ctx, volumeID, opts.SSE); err != nil {
+		return fmt.Errorf("encryption of volume %s was not accepted by the backend: %w", volumeID, err)
+	}
+	meta := newMetadata(volumeID, capacityBytes, opts, v.Version, time.Now())
+	if meta.ScopedCredentials, err = cs.createScopedCredentials(ctx, s3, volumeID, opts); err != nil {
+		return err
+	}
+	if err := cs.metadata.put(ctx, s3, meta); err != nil {
+		// without metadata the credentials would never be revoked
+		if meta.ScopedCredentials != nil {
+			if rerr := cs.revokeCredentials(ctx, s3, meta.ScopedCredentials); rerr != nil {
+				klog.FromContext(ctx).Error(rerr, "Failed to revoke scoped credentials", "accessKeyID", meta.ScopedCredentials.AccessKeyID)
+			}
 		}
+		return fmt.Errorf("Error setting volume metadata: %w", err)
 	}
 	return nil
 }
+
+func (cs *controllerServer) createScopedCredentials(ctx context.Context, s3 *s3Client, volumeID string, opts *bucketOptions) (*scopedCredentials, error) {
+	if opts.ScopedCredentials == "" {
+		return nil, nil
+	}
+	provisioner, err := newCredentialsProvisioner(opts.ScopedCredentials, s3, cs.driverName, cs.metadataName)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := provisioner.create(ctx, volumeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scoped credentials for volume %s: %w", volumeID, err)
+	}
+	return creds, nil
+}
+
+func (cs *controllerServer) revokeScopedCredentials(ctx context.Context, s3 *s3Client, volumeID string) error {
+	exists, err := cs.metadata.exists(ctx, s3, volumeID)
+	if err != nil || !exists {
+		return err
+	}
+	meta, err := cs.metadata.get(ctx, s3, volumeID)
+	if errors.Is(err, errMetadataVersion) {
+		// the volume must still be removable after a downgrade of the controller
+		klog.FromContext(ctx).Error(err, "Unable to revoke scoped credentials of the volume, they must be removed by hand")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of volume %s: %w", volumeID, err)
+	}
+	if meta.ScopedCredentials == nil {
+		return nil
+	}
+	return cs.revokeCredentials(ctx, s3, meta.ScopedCredentials)
+}
+
+func (cs *controllerServer) revokeCredentials(ctx context.Context, s3 *s3Client, creds *scopedCredentials) error {
+	provisioner, err := newCredentialsProvisioner(creds.Provider, s3, cs.driverName, cs.metadataName)
+	if err != nil {
+		return err
+	}
+	return provisioner.revoke(ctx, creds)
+}
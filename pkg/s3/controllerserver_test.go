@@ -16,7 +16,19 @@ limitations under the License.
 
 package s3
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
 
 func Test_sanitizeVolumeID(t *testing.T) {
 	tests := []struct {
@@ -49,3 +61,188 @@ func Test_sanitizeVolumeID(t *testing.T) {
 		})
 	}
 }
+
+// newFakeControllerServer returns a controller server with the object metadata store
+func newFakeControllerServer() *controllerServer {
+	return &controllerServer{
+		clients:      newClientCache(ClientCacheOptions{}),
+		volumeLocks:  newVolumeLocks(),
+		metadata:     &objectMetadataStore{name: defaultMetadataName},
+		driverName:   DefaultDriverName,
+		metadataName: defaultMetadataName,
+	}
+}
+
+func Test_ensureBucketWithMetadataRetry(t *testing.T) {
+	ctx := context.Background()
+	failVersioning := true
+	fake := &fakeS3{
+		fail: func(r *http.Request) string {
+			if failVersioning && r.Method == http.MethodPut && r.URL.Query().Has("versioning") {
+				return "AccessDenied"
+			}
+			return ""
+		},
+	}
+	secrets := startFakeS3(t, fake)
+	cs := newFakeControllerServer()
+	opts := &bucketOptions{
+		FSPath:     defaultFSPrefix,
+		Versioning: true,
+		Lifecycle:  &lifecycleConfig{ExpirationDays: 30},
+		Tags:       map[string]string{tagClusterID: "cluster-a"},
+	}
+
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, opts); err == nil {
+		t.Fatal("ensureBucketWithMetadata() succeeded although versioning failed")
+	}
+	bucket := fake.bucket("pvc-1")
+	if bucket == nil || bucket.latest(defaultMetadataName) != nil {
+		t.Fatal("failed attempt must leave the bucket without metadata")
+	}
+
+	failVersioning = false
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, opts); err != nil {
+		t.Fatalf("ensureBucketWithMetadata() retry error = %v", err)
+	}
+	bucket = fake.bucket("pvc-1")
+	if !bucket.versioning {
+		t.Error("versioning was not enabled by the retry")
+	}
+	for _, sub := range []string{"lifecycle", "tagging"} {
+		if _, ok := bucket.subresources[sub]; !ok {
+			t.Errorf("%s was not set by the retry", sub)
+		}
+	}
+	for _, key := range []string{defaultFSPrefix + "/", defaultMetadataName} {
+		if bucket.latest(key) == nil {
+			t.Errorf("%s was not created by the retry", key)
+		}
+	}
+}
+
+func Test_ensureBucketWithMetadataAlreadyExists(t *testing.T) {
+	existing := &bucketOptions{
+		FSPath:     defaultFSPrefix,
+		Versioning: true,
+		Lifecycle:  &lifecycleConfig{ExpirationDays: 30},
+	}
+	tests := []struct {
+		name     string
+		capacity int64
+		opts     *bucketOptions
+		wantCode codes.Code
+	}{
+		{
+			name:     "same options",
+			capacity: 1024,
+			opts:     &bucketOptions{FSPath: defaultFSPrefix, Versioning: true, Lifecycle: &lifecycleConfig{ExpirationDays: 30}},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "larger",
+			capacity: 2048,
+			opts:     existing,
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "without versioning",
+			capacity: 1024,
+			opts:     &bucketOptions{FSPath: defaultFSPrefix, Lifecycle: &lifecycleConfig{ExpirationDays: 30}},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "different lifecycle",
+			capacity: 1024,
+			opts:     &bucketOptions{FSPath: defaultFSPrefix, Versioning: true, Lifecycle: &lifecycleConfig{ExpirationDays: 7}},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "with object lock",
+			capacity: 1024,
+			opts: &bucketOptions{
+				FSPath:     defaultFSPrefix,
+				Versioning: true,
+				Lifecycle:  &lifecycleConfig{ExpirationDays: 30},
+				ObjectLock: &objectLockConfig{Mode: "GOVERNANCE", RetentionDays: 1},
+			},
+			wantCode: codes.AlreadyExists,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			secrets := startFakeS3(t, &fakeS3{})
+			cs := newFakeControllerServer()
+			if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, existing); err != nil {
+				t.Fatal(err)
+			}
+			err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, tt.capacity, tt.opts)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("ensureBucketWithMetadata() code = %v, want %v, error = %v", got, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func Test_removeVolumeOfNewerMetadata(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{}
+	secrets := startFakeS3(t, fake)
+	cs := newFakeControllerServer()
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, &bucketOptions{FSPath: defaultFSPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeS3Client(t, fake)
+	meta := newMetadata("pvc-1", 1024, &bucketOptions{FSPath: defaultFSPrefix}, "", time.Now())
+	meta.Version = metadataVersion + 1
+	if err := cs.metadata.put(ctx, client, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.removeVolume(ctx, client, "pvc-1"); err != nil {
+		t.Fatalf("removeVolume() error = %v", err)
+	}
+	if fake.bucket("pvc-1") != nil {
+		t.Error("bucket of the volume was not removed")
+	}
+}
+
+func Test_removeVolumeRetriesMetadata(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{}
+	secrets := startFakeS3(t, fake)
+	clientset := k8sfake.NewSimpleClientset()
+	failDelete := true
+	clientset.PrependReactor("delete", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failDelete {
+			return true, nil, errors.New("injected")
+		}
+		return false, nil, nil
+	})
+	cs := newFakeControllerServer()
+	cs.metadata = &kubernetesMetadataStore{secrets: clientset.CoreV1().Secrets("kube-system")}
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, &bucketOptions{FSPath: defaultFSPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeS3Client(t, fake)
+
+	if err := cs.removeVolume(ctx, client, "pvc-1"); err == nil {
+		t.Fatal("removeVolume() succeeded although the metadata was not removed")
+	}
+	if fake.bucket("pvc-1") == nil {
+		t.Fatal("bucket must be kept until the metadata is removed")
+	}
+
+	failDelete = false
+	if err := cs.removeVolume(ctx, client, "pvc-1"); err != nil {
+		t.Fatalf("removeVolume() retry error = %v", err)
+	}
+	if fake.bucket("pvc-1") != nil {
+		t.Error("bucket was not removed by the retry")
+	}
+	if exists, err := cs.metadata.exists(ctx, client, "pvc-1"); err != nil || exists {
+		t.Errorf("metadata was not removed by the retry, exists = %v, error = %v", exists, err)
+	}
+}
@@ -0,0 +1,110 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Providers which can be given in credentialsChain
+const (
+	// credentialsStatic uses accessKeyID and secretAccessKey from the secret
+	credentialsStatic = "static"
+	// credentialsEnv uses AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or MINIO_ACCESS_KEY/MINIO_SECRET_KEY of the driver
+	credentialsEnv = "env"
+	// credentialsWebIdentity calls AssumeRoleWithWebIdentity with a service account token
+	credentialsWebIdentity = "webIdentity"
+	// credentialsIAM uses IRSA, ECS task roles or the EC2 instance metadata service
+	credentialsIAM = "iam"
+)
+
+var defaultCredentialsChain = []string{credentialsStatic, credentialsEnv, credentialsWebIdentity, credentialsIAM}
+
+// newCredentials returns the credentials of the first provider in the chain which has some
+func newCredentials(cfg *Config, transport http.RoundTripper) (*credentials.Credentials, error) {
+	chain := cfg.CredentialsChain
+	if len(chain) == 0 {
+		chain = defaultCredentialsChain
+	}
+	var providers []credentials.Provider
+	for _, name := range chain {
+		switch name {
+		case credentialsStatic:
+			providers = append(providers, &credentials.Static{
+				Value: credentials.Value{
+					AccessKeyID:     cfg.AccessKeyID,
+					SecretAccessKey: cfg.SecretAccessKey,
+					SessionToken:    cfg.SessionToken,
+					SignerType:      credentials.SignatureV4,
+				},
+			})
+		case credentialsEnv:
+			providers = append(providers, &credentials.EnvAWS{}, &credentials.EnvMinio{})
+		case credentialsWebIdentity:
+			if p := newWebIdentityProvider(cfg, transport); p != nil {
+				providers = append(providers, p)
+			}
+		case credentialsIAM:
+			// the metadata services are link local, they must not be reached through the proxy of the endpoint
+			providers = append(providers, &credentials.IAM{
+				Client: &http.Client{Transport: http.DefaultTransport},
+			})
+		default:
+			return nil, fmt.Errorf("unknown credentials provider %q in credentialsChain, must be one of %s", name, strings.Join(defaultCredentialsChain, ","))
+		}
+	}
+	return credentials.New(&signatureProvider{
+		Provider:   &credentials.Chain{Providers: providers},
+		signerType: cfg.signerType(),
+	}), nil
+}
+
+// newWebIdentityProvider returns nil if no token file is configured
+func newWebIdentityProvider(cfg *Config, transport http.RoundTripper) credentials.Provider {
+	tokenFile := cfg.WebIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if tokenFile == "" {
+		return nil
+	}
+	roleARN := cfg.RoleARN
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	stsEndpoint := cfg.STSEndpoint
+	if stsEndpoint == "" {
+		// MinIO serves STS on the S3 endpoint
+		stsEndpoint = cfg.Endpoint
+		if stsEndpoint == "" || strings.Contains(stsEndpoint, "amazonaws.com") {
+			stsEndpoint = credentials.DefaultSTSRoleEndpoint
+		}
+	}
+	return &credentials.STSWebIdentity{
+		Client:      &http.Client{Transport: transport},
+		STSEndpoint: stsEndpoint,
+		RoleARN:     roleARN,
+		GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+			// the projected token is rotated by the kubelet, always read the current one
+			token, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read web identity token: %w", err)
+			}
+			return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+		},
+	}
+}
+
+// parseCredentialsChain parses the comma separated list of providers given in the secret
+func parseCredentialsChain(chain string) []string {
+	var providers []string
+	for _, p := range strings.Split(chain, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
@@ -0,0 +1,75 @@
+package s3
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_newCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantKey string
+		wantErr bool
+	}{
+		{
+			name:    "static first",
+			cfg:     &Config{AccessKeyID: "static-key", SecretAccessKey: "static-secret"},
+			wantKey: "static-key",
+		},
+		{
+			name:    "fall back to env without static keys",
+			cfg:     &Config{},
+			wantKey: "env-key",
+		},
+		{
+			name:    "chain order is respected",
+			cfg:     &Config{AccessKeyID: "static-key", SecretAccessKey: "static-secret", CredentialsChain: []string{"env", "static"}},
+			wantKey: "env-key",
+		},
+		{
+			name:    "no provider with credentials",
+			cfg:     &Config{CredentialsChain: []string{"static"}},
+			wantKey: "",
+		},
+		{
+			name:    "unknown provider",
+			cfg:     &Config{CredentialsChain: []string{"static", "kerberos"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := newCredentials(tt.cfg, http.DefaultTransport)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newCredentials() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			value, err := creds.Get()
+			if err != nil {
+				t.Errorf("Get() error = %v", err)
+				return
+			}
+			if value.AccessKeyID != tt.wantKey {
+				t.Errorf("newCredentials() access key = %v, want %v", value.AccessKeyID, tt.wantKey)
+			}
+		})
+	}
+}
+
+func Test_parseCredentialsChain(t *testing.T) {
+	got := parseCredentialsChain(" webIdentity, iam,,")
+	if len(got) != 2 || got[0] != "webIdentity" || got[1] != "iam" {
+		t.Errorf("parseCredentialsChain() = %v", got)
+	}
+	if got := parseCredentialsChain(""); got != nil {
+		t.Errorf("parseCredentialsChain() = %v, want nil", got)
+	}
+}
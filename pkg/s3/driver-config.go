@@ -0,0 +1,289 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultDriverName is the name the driver registers with, StorageClasses refer to it as provisioner
+const DefaultDriverName = "s3.csi.metal-stack.io"
+
+// envPrefix is the prefix of all environment variables which override the configuration file
+const envPrefix = "CSI_S3_"
+
+// driverNameRegex is the format of driver names required by the CSI spec
+var driverNameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?$`)
+
+// DriverConfig is the configuration of the driver. It is read from a YAML or JSON file,
+// environment variables prefixed with CSI_S3_ override the file and command line flags override both.
+type DriverConfig struct {
+	// NodeID is the id of the node the driver runs on
+	NodeID string `json:"nodeID,omitempty"`
+	// Endpoint is the CSI endpoint, unix:// or tcp://
+	Endpoint string `json:"endpoint,omitempty"`
+	// ClusterID is set as tag on all created buckets
+	ClusterID string `json:"clusterID,omitempty"`
+	// Mode is one of ModeController, ModeNode or ModeAll
+	Mode string `json:"mode,omitempty"`
+	// DriverName must match the provisioner of the StorageClasses
+	DriverName string `json:"driverName,omitempty"`
+	// MetadataName is the name of the object of MetadataStoreObject in every bucket
+	MetadataName string `json:"metadataName,omitempty"`
+	// FSPrefix is the prefix in the bucket of new volumes which is mounted, existing volumes keep their prefix
+	FSPrefix string `json:"fsPrefix,omitempty"`
+	// DefaultMounter is used for volumes whose StorageClass does not set the mounter parameter
+	DefaultMounter string `json:"defaultMounter,omitempty"`
+	// Mounters holds the default options per mounter, s3fs and gocryptfs
+	Mounters map[string]MounterOptions `json:"mounters,omitempty"`
+	// DefaultParameters are used for all parameters which are not set in the StorageClass
+	DefaultParameters map[string]string `json:"defaultParameters,omitempty"`
+	// MetricsAddress is the host:port of the prometheus metrics, they are not served if empty
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// LogFormat is LogFormatText or LogFormatJSON
+	LogFormat string `json:"logFormat,omitempty"`
+	// ProbeEndpoint is the URL of an S3 endpoint which must be reachable for Probe of the controller to succeed
+	ProbeEndpoint string `json:"probeEndpoint,omitempty"`
+	// StateDir holds the files of the mounts of a node, it must be on the host to survive restarts of the driver
+	StateDir string `json:"stateDir,omitempty"`
+
+	ClientCache   ClientCacheOptions   `json:"clientCache"`
+	MetadataStore MetadataStoreOptions `json:"metadataStore"`
+	Tracing       TracingOptions       `json:"tracing"`
+	Topology      TopologyOptions      `json:"topology"`
+	Reaper        ReaperOptions        `json:"reaper"`
+}
+
+// MounterOptions are the default options of a mounter
+type MounterOptions struct {
+	// Options are passed with -o after the options set by the driver
+	Options []string `json:"options,omitempty"`
+}
+
+// DefaultDriverConfig returns the configuration used if no file is given
+func DefaultDriverConfig() *DriverConfig {
+	return &DriverConfig{
+		Endpoint:       "unix://tmp/csi.sock",
+		Mode:           ModeAll,
+		DriverName:     DefaultDriverName,
+		MetadataName:   defaultMetadataName,
+		FSPrefix:       defaultFSPrefix,
+		DefaultMounter: mounterS3fs,
+		LogFormat:      LogFormatText,
+		ClientCache:    DefaultClientCacheOptions,
+		MetadataStore:  MetadataStoreOptions{Type: MetadataStoreObject},
+		Tracing:        DefaultTracingOptions,
+	}
+}
+
+// LoadDriverConfig reads the configuration file at path on top of the defaults, an empty path returns the defaults
+func LoadDriverConfig(path string) (*DriverConfig, error) {
+	cfg := DefaultDriverConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	// YAML is a superset of JSON, unknown fields are rejected to catch typos
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides the configuration with the environment variables returned by lookup, usually os.LookupEnv
+func (c *DriverConfig) ApplyEnv(lookup func(key string) (string, bool)) error {
+	setString := func(field *string) func(string) error {
+		return func(value string) error {
+			*field = value
+			return nil
+		}
+	}
+	setInt := func(field *int) func(string) error {
+		return func(value string) error {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			*field = i
+			return nil
+		}
+	}
+	setDuration := func(field *time.Duration) func(string) error {
+		return func(value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			*field = d
+			return nil
+		}
+	}
+	setBool := func(field *bool) func(string) error {
+		return func(value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			*field = b
+			return nil
+		}
+	}
+	setFloat := func(field *float64) func(string) error {
+		return func(value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			*field = f
+			return nil
+		}
+	}
+	setSegments := func(field *map[string]string) func(string) error {
+		return func(value string) error {
+			segments, err := ParseSegments(value)
+			if err != nil {
+				return err
+			}
+			*field = segments
+			return nil
+		}
+	}
+	setList := func(field *[]string) func(string) error {
+		return func(value string) error {
+			*field = ParseList(value)
+			return nil
+		}
+	}
+	overrides := []struct {
+		name string
+		set  func(string) error
+	}{
+		{name: "NODE_ID", set: setString(&c.NodeID)},
+		{name: "ENDPOINT", set: setString(&c.Endpoint)},
+		{name: "CLUSTER_ID", set: setString(&c.ClusterID)},
+		{name: "MODE", set: setString(&c.Mode)},
+		{name: "DRIVER_NAME", set: setString(&c.DriverName)},
+		{name: "METADATA_NAME", set: setString(&c.MetadataName)},
+		{name: "FS_PREFIX", set: setString(&c.FSPrefix)},
+		{name: "DEFAULT_MOUNTER", set: setString(&c.DefaultMounter)},
+		{name: "METRICS_ADDRESS", set: setString(&c.MetricsAddress)},
+		{name: "LOG_FORMAT", set: setString(&c.LogFormat)},
+		{name: "PROBE_ENDPOINT", set: setString(&c.ProbeEndpoint)},
+		{name: "STATE_DIR", set: setString(&c.StateDir)},
+		{name: "CLIENT_CACHE_TTL", set: setDuration(&c.ClientCache.TTL)},
+		{name: "MAX_IDLE_CONNS", set: setInt(&c.ClientCache.MaxIdleConns)},
+		{name: "MAX_IDLE_CONNS_PER_HOST", set: setInt(&c.ClientCache.MaxIdleConnsPerHost)},
+		{name: "METADATA_STORE", set: setString(&c.MetadataStore.Type)},
+		{name: "METADATA_NAMESPACE", set: setString(&c.MetadataStore.Namespace)},
+		{name: "TRACING_ENDPOINT", set: setString(&c.Tracing.Endpoint)},
+		{name: "TRACING_INSECURE", set: setBool(&c.Tracing.Insecure)},
+		{name: "TRACING_SAMPLE_RATIO", set: setFloat(&c.Tracing.SampleRatio)},
+		{name: "TOPOLOGY_SEGMENTS", set: setSegments(&c.Topology.Segments)},
+		{name: "TOPOLOGY_NODE_LABELS", set: setList(&c.Topology.NodeLabels)},
+		{name: "REAPER_INTERVAL", set: setDuration(&c.Reaper.Interval)},
+		{name: "REAPER_SECRET_NAME", set: setString(&c.Reaper.SecretName)},
+		{name: "REAPER_SECRET_NAMESPACE", set: setString(&c.Reaper.SecretNamespace)},
+	}
+	var errs []error
+	for _, o := range overrides {
+		value, ok := lookup(envPrefix + o.name)
+		if !ok {
+			continue
+		}
+		if err := o.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s%s: %w", envPrefix, o.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate returns all errors of the configuration
+func (c *DriverConfig) Validate() error {
+	var errs []error
+	if _, err := parseMode(c.Mode); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := csicommon.ParseEndpoint(c.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("invalid endpoint %q: %w", c.Endpoint, err))
+	}
+	if c.NodeID == "" {
+		// csi-common requires it in all modes
+		errs = append(errs, errors.New("nodeID is required"))
+	}
+	if !driverNameRegex.MatchString(c.DriverName) {
+		errs = append(errs, fmt.Errorf("invalid driverName %q, must be at most 63 alphanumeric characters, '-', '_' or '.' and start and end with an alphanumeric character", c.DriverName))
+	}
+	if c.FSPrefix == "" || strings.HasPrefix(c.FSPrefix, "/") || strings.HasSuffix(c.FSPrefix, "/") {
+		errs = append(errs, fmt.Errorf("invalid fsPrefix %q, must not be empty or start or end with /", c.FSPrefix))
+	}
+	if c.MetadataName == "" || strings.Contains(c.MetadataName, "/") {
+		errs = append(errs, fmt.Errorf("invalid metadataName %q, must not be empty or contain /", c.MetadataName))
+	} else if c.MetadataName == c.FSPrefix {
+		errs = append(errs, fmt.Errorf("metadataName and fsPrefix must differ, both are %q", c.MetadataName))
+	}
+	if mounter, err := parseMounter(c.DefaultMounter); err != nil {
+		errs = append(errs, fmt.Errorf("invalid defaultMounter: %w", err))
+	} else if mounter == "" {
+		errs = append(errs, errors.New("defaultMounter is required"))
+	}
+	for name, opts := range c.Mounters {
+		if name != mounterS3fs && name != cseGocryptfs {
+			errs = append(errs, fmt.Errorf("options given for unknown mounter %q, must be %s or %s", name, mounterS3fs, cseGocryptfs))
+		}
+		for _, opt := range opts.Options {
+			if strings.TrimSpace(opt) == "" {
+				errs = append(errs, fmt.Errorf("empty option of mounter %s", name))
+			}
+		}
+	}
+	if _, err := parseBucketOptions(c.DefaultParameters); err != nil {
+		errs = append(errs, fmt.Errorf("invalid defaultParameters: %w", err))
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			errs = append(errs, fmt.Errorf("invalid metricsAddress %q: %w", c.MetricsAddress, err))
+		}
+	}
+	if _, err := parseLogFormat(c.LogFormat); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ProbeEndpoint != "" {
+		if _, err := endpointAddress(c.ProbeEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid probeEndpoint: %w", err))
+		}
+	}
+	if c.StateDir != "" && !filepath.IsAbs(c.StateDir) {
+		errs = append(errs, fmt.Errorf("invalid stateDir %q, must be an absolute path", c.StateDir))
+	}
+	if c.ClientCache.TTL < 0 || c.ClientCache.MaxIdleConns < 0 || c.ClientCache.MaxIdleConnsPerHost < 0 {
+		errs = append(errs, errors.New("the options of the clientCache must not be negative"))
+	}
+	if _, err := parseMetadataStore(c.MetadataStore.Type); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Topology.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Reaper.validate(c.ClusterID); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid driver configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package s3
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LoadDriverConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		want    func(cfg *DriverConfig)
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: `
+nodeID: node-1
+driverName: s3.example.com
+fsPrefix: data
+mounters:
+  s3fs:
+    options: ["max_stat_cache_size=1000"]
+defaultParameters:
+  versioning: "true"
+clientCache:
+  ttl: 5m
+metadataStore:
+  type: bucket-tags
+topology:
+  sites:
+    - name: dc1
+      segments: {topology.kubernetes.io/zone: dc1}
+      endpoint: https://s3.dc1.example.com
+`,
+			want: func(cfg *DriverConfig) {
+				cfg.NodeID = "node-1"
+				cfg.DriverName = "s3.example.com"
+				cfg.FSPrefix = "data"
+				cfg.Mounters = map[string]MounterOptions{mounterS3fs: {Options: []string{"max_stat_cache_size=1000"}}}
+				cfg.DefaultParameters = map[string]string{paramVersioning: "true"}
+				cfg.ClientCache.TTL = 5 * time.Minute
+				cfg.MetadataStore.Type = MetadataStoreBucketTags
+				cfg.Topology.Sites = []TopologySite{{Name: "dc1", Segments: map[string]string{"topology.kubernetes.io/zone": "dc1"}, Endpoint: "https://s3.dc1.example.com"}}
+			},
+		},
+		{
+			name: "json with environment",
+			file: `{"nodeID": "node-1", "mode": "node"}`,
+			env: map[string]string{
+				"CSI_S3_NODE_ID":            "node-2",
+				"CSI_S3_CLIENT_CACHE_TTL":   "1m",
+				"CSI_S3_MAX_IDLE_CONNS":     "10",
+				"CSI_S3_TRACING_ENDPOINT":   "otel-collector:4317",
+				"CSI_S3_TOPOLOGY_SEGMENTS":  "topology.kubernetes.io/zone=dc1, example.com/rack=r1",
+				"CSI_S3_CLUSTER_ID":         "cluster-a",
+				"CSI_S3_REAPER_INTERVAL":    "1h",
+				"CSI_S3_REAPER_SECRET_NAME": "csi-driver-s3-secret",
+			},
+			want: func(cfg *DriverConfig) {
+				cfg.NodeID = "node-2"
+				cfg.Mode = ModeNode
+				cfg.ClientCache.TTL = time.Minute
+				cfg.ClientCache.MaxIdleConns = 10
+				cfg.Tracing.Endpoint = "otel-collector:4317"
+				cfg.Topology.Segments = map[string]string{"topology.kubernetes.io/zone": "dc1", "example.com/rack": "r1"}
+				cfg.ClusterID = "cluster-a"
+				cfg.Reaper.Interval = time.Hour
+				cfg.Reaper.SecretName = "csi-driver-s3-secret"
+			},
+		},
+		{
+			name:    "unknown field",
+			file:    `fsPrefx: data`,
+			wantErr: `unknown field "fsPrefx"`,
+		},
+		{
+			name:    "unknown field of client cache",
+			file:    `clientCache: {size: 10}`,
+			wantErr: `unknown field "size"`,
+		},
+		{
+			name:    "invalid environment",
+			file:    `nodeID: node-1`,
+			env:     map[string]string{"CSI_S3_MAX_IDLE_CONNS": "many"},
+			wantErr: "invalid CSI_S3_MAX_IDLE_CONNS",
+		},
+		{
+			name: "invalid",
+			file: `
+mode: attacher
+driverName: -s3-
+fsPrefix: /data
+defaultMounter: rclone
+mounters:
+  goofys: {}
+defaultParameters:
+  encryption: none
+metadataStore:
+  type: etcd
+probeEndpoint: minio:9000
+topology:
+  sites:
+    - name: dc1
+      endpoint: s3.dc1.example.com
+tracing:
+  endpoint: collector
+  sampleRatio: 2
+reaper:
+  interval: 1h
+`,
+			wantErr: strings.Join([]string{
+				`unsupported mode "attacher"`,
+				`invalid driverName "-s3-"`,
+				`invalid fsPrefix "/data"`,
+				`invalid defaultMounter`,
+				`unknown mounter "goofys"`,
+				`invalid defaultParameters`,
+				`unsupported metadata store "etcd"`,
+				`invalid probeEndpoint`,
+				`invalid tracing endpoint "collector"`,
+				`topology site dc1 has no segments`,
+				`topology site dc1: invalid endpoint`,
+				`invalid tracing sampleRatio 2`,
+				`the reaper requires a secretName`,
+				`the reaper requires a clusterID`,
+			}, "|"),
+		},
+		{
+			name:    "node id required",
+			file:    `mode: controller`,
+			wantErr: "nodeID is required",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadDriverConfig(path)
+			if err == nil {
+				err = cfg.ApplyEnv(func(key string) (string, bool) {
+					value, ok := tt.env[key]
+					return value, ok
+				})
+			}
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error %q", tt.wantErr)
+				}
+				for _, want := range strings.Split(tt.wantErr, "|") {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := DefaultDriverConfig()
+			tt.want(want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("LoadDriverConfig() = %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
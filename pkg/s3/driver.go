@@ -17,6 +17,8 @@ limitations under the License.
 package s3
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
 
@@ -25,65 +27,201 @@ import (
 )
 
 type driver struct {
-	driver   *csicommon.CSIDriver
-	endpoint string
+	driver    *csicommon.CSIDriver
+	endpoint  string
+	clusterID string
+	// name and metadataName are the same for all volumes of the driver
+	name         string
+	metadataName string
+	// stateDir holds the files of the mounts of a node
+	stateDir stateDir
+	// mode selects the services the driver serves
+	mode     string
+	clients  *clientCache
+	metadata metadataStore
+	// fsPrefix, defaultMounter and defaultParameters apply to new volumes
+	fsPrefix          string
+	defaultMounter    string
+	defaultParameters map[string]string
+	mounters          map[string]MounterOptions
+	metricsAddress    string
+	probeEndpoint     string
+	topology          TopologyOptions
+	nodeTopology      *nodeTopology
+	encryptionKeys    *encryptionKeys
+	// reaper removes orphaned ephemeral volumes, it is nil if disabled or not running as controller
+	reaper *reaper
+	// stopTracing flushes the spans which are not exported yet
+	stopTracing func(context.Context) error
 
 	ids *identityServer
 	ns  *nodeServer
 	cs  *controllerServer
 }
 
-var (
-	driverName = "s3.csi.metal-stack.io"
-)
+// New initializes the driver with a validated configuration
+func New(cfg *DriverConfig) (*driver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := setupLogging(cfg.LogFormat); err != nil {
+		return nil, err
+	}
+	mode, err := parseMode(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	dir := stateDir(defaultStateDir)
+	if cfg.StateDir != "" {
+		dir = stateDir(cfg.StateDir)
+	}
 
-// New initializes the driver
-func New(nodeID string, endpoint string) (*driver, error) {
-	drv := csicommon.NewCSIDriver(driverName, v.Version, nodeID)
+	drv := csicommon.NewCSIDriver(cfg.DriverName, v.Version, cfg.NodeID)
 	if drv == nil {
 		klog.Fatalln("Failed to initialize CSI Driver.")
 	}
+	store, err := newMetadataStore(cfg.MetadataStore, cfg.DriverName, cfg.MetadataName)
+	if err != nil {
+		return nil, err
+	}
+	stopTracing, err := setupTracing(cfg.Tracing, cfg.DriverName, cfg.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		topology *nodeTopology
+		keys     *encryptionKeys
+	)
+	if runsNode(mode) {
+		if topology, err = newNodeTopology(cfg.Topology, cfg.NodeID); err != nil {
+			return nil, err
+		}
+		if keys, err = newEncryptionKeys(); err != nil {
+			return nil, err
+		}
+	}
+	var r *reaper
+	if runsController(mode) && cfg.Reaper.Interval > 0 {
+		if r, err = newReaper(cfg.Reaper, cfg.ClusterID); err != nil {
+			return nil, err
+		}
+	}
 
 	s3d := &driver{
-		endpoint: endpoint,
-		driver:   drv,
+		endpoint:          cfg.Endpoint,
+		driver:            drv,
+		clusterID:         cfg.ClusterID,
+		name:              cfg.DriverName,
+		metadataName:      cfg.MetadataName,
+		stateDir:          dir,
+		mode:              mode,
+		clients:           newClientCache(cfg.ClientCache),
+		metadata:          store,
+		fsPrefix:          cfg.FSPrefix,
+		defaultMounter:    cfg.DefaultMounter,
+		defaultParameters: cfg.DefaultParameters,
+		mounters:          cfg.Mounters,
+		metricsAddress:    cfg.MetricsAddress,
+		probeEndpoint:     cfg.ProbeEndpoint,
+		topology:          cfg.Topology,
+		nodeTopology:      topology,
+		encryptionKeys:    keys,
+		reaper:            r,
+		stopTracing:       stopTracing,
 	}
 	return s3d, nil
 }
 
 func (s3 *driver) newIdentityServer(d *csicommon.CSIDriver) *identityServer {
+	var checks []probeCheck
+	if runsNode(s3.mode) {
+		checks = append(checks, nodeChecks(s3.defaultParameters)...)
+	}
+	if runsController(s3.mode) && s3.probeEndpoint != "" {
+		checks = append(checks, endpointCheck(s3.probeEndpoint))
+	}
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		controller:            runsController(s3.mode),
+		topology:              s3.topology.enabled(),
+		checks:                checks,
 	}
 }
 
 func (s3 *driver) newControllerServer(d *csicommon.CSIDriver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		clusterID:               s3.clusterID,
+		driverName:              s3.name,
+		metadataName:            s3.metadataName,
+		clients:                 s3.clients,
+		volumeLocks:             newVolumeLocks(),
+		metadata:                s3.metadata,
+		fsPrefix:                s3.fsPrefix,
+		defaultMounter:          s3.defaultMounter,
+		defaultParameters:       s3.defaultParameters,
+		sites:                   s3.topology.Sites,
 	}
 }
 
 func (s3 *driver) newNodeServer(d *csicommon.CSIDriver) *nodeServer {
+	locks := newVolumeLocks()
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		refresher:         newCredentialsRefresher(locks),
+		clients:           s3.clients,
+		volumeLocks:       locks,
+		metadata:          s3.metadata,
+		mounters:          s3.mounters,
+		stateDir:          s3.stateDir,
+		topology:          s3.nodeTopology,
+		keys:              s3.encryptionKeys,
 	}
 }
 
-// Run the driver
-func (s3 *driver) Run() {
-	klog.Infof("Driver: %v ", driverName)
-	klog.Infof("Version: %v ", v.V)
+// Run the driver until its GRPC server stops, a node is checked to be able to mount volumes first
+func (s3 *driver) Run() error {
+	if runsNode(s3.mode) {
+		if err := checkFusePrerequisites(); err != nil {
+			return err
+		}
+	}
+	klog.InfoS("Starting driver", "driver", s3.name, "version", v.V, "mode", s3.mode)
 	// Initialize default library driver
 
-	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
 	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
-	// Create GRPC servers
+	// Create GRPC servers, only the services of the mode are registered
+	var (
+		cs csi.ControllerServer
+		ns csi.NodeServer
+	)
 	s3.ids = s3.newIdentityServer(s3.driver)
-	s3.ns = s3.newNodeServer(s3.driver)
-	s3.cs = s3.newControllerServer(s3.driver)
+	if runsController(s3.mode) {
+		s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+		s3.cs = s3.newControllerServer(s3.driver)
+		cs = s3.cs
+		if s3.reaper != nil {
+			s3.reaper.cs = s3.cs
+			go s3.reaper.run()
+		}
+	}
+	if runsNode(s3.mode) {
+		s3.ns = s3.newNodeServer(s3.driver)
+		ns = s3.ns
+		go s3.ns.refresher.run()
+	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(s3.endpoint, s3.ids, s3.cs, s3.ns)
+	if s3.metricsAddress != "" {
+		go serveMetrics(s3.metricsAddress)
+	}
+
+	s := newNonBlockingGRPCServer(metricsInterceptor)
+	s.Start(s3.endpoint, s3.ids, cs, ns)
 	s.Wait()
+
+	if err := s3.stopTracing(context.Background()); err != nil {
+		klog.ErrorS(err, "Unable to flush traces")
+	}
+	return nil
 }
@@ -19,11 +19,20 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := s3.New("test-node", csiEndpoint)
+		cfg := s3.DefaultDriverConfig()
+		cfg.NodeID = "test-node"
+		cfg.Endpoint = csiEndpoint
+		cfg.ClusterID = "test-cluster"
+		driver, err := s3.New(cfg)
 		if err != nil {
 			log.Fatal(err)
 		}
-		go driver.Run()
+		go func() {
+			// the sanity tests fail without the mount prerequisites, the other tests still run
+			if err := driver.Run(); err != nil {
+				log.Print(err)
+			}
+		}()
 
 		Describe("CSI sanity", func() {
 			sanityCfg := &sanity.TestConfig{
@@ -27,3 +27,39 @@ func TestS3Driver(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "S3Driver")
 }
+
+func Test_newDriversAreIndependent(t *testing.T) {
+	newDriver := func(name, metadataName, stateDir string) *driver {
+		cfg := DefaultDriverConfig()
+		cfg.NodeID = "node-1"
+		cfg.DriverName = name
+		cfg.MetadataName = metadataName
+		cfg.StateDir = stateDir
+		d, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	a := newDriver("a.example.com", "a.json", "/var/lib/a")
+	b := newDriver("b.example.com", "b.json", "/var/lib/b")
+
+	for _, tt := range []struct {
+		d                                  *driver
+		driverName, metadataName, stateDir string
+	}{
+		{d: a, driverName: "a.example.com", metadataName: "a.json", stateDir: "/var/lib/a"},
+		{d: b, driverName: "b.example.com", metadataName: "b.json", stateDir: "/var/lib/b"},
+	} {
+		cs := tt.d.newControllerServer(tt.d.driver)
+		if cs.driverName != tt.driverName || cs.metadataName != tt.metadataName {
+			t.Errorf("controller server names = %s, %s, want %s, %s", cs.driverName, cs.metadataName, tt.driverName, tt.metadataName)
+		}
+		if got := cs.metadata.(*fallbackMetadataStore).metadataStore.(*objectMetadataStore).name; got != tt.metadataName {
+			t.Errorf("metadata object = %s, want %s", got, tt.metadataName)
+		}
+		if ns := tt.d.newNodeServer(tt.d.driver); string(ns.stateDir) != tt.stateDir {
+			t.Errorf("node server stateDir = %s, want %s", ns.stateDir, tt.stateDir)
+		}
+	}
+}
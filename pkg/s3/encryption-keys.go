@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// keyEncryptionPassphrase is the key of the passphrase in the key secret of a volume and in the secret of the node
+const keyEncryptionPassphrase = "encryptionPassphrase"
+
+// encryptionKeys reads the passphrases of volumes encrypted on the client
+type encryptionKeys struct {
+	// client is nil if the driver does not run in kubernetes, only the secret of the node can be used then
+	client kubernetes.Interface
+}
+
+func newEncryptionKeys() (*encryptionKeys, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.InfoS("Not running in kubernetes, key secrets of encrypted volumes are not supported", "err", err)
+		return &encryptionKeys{}, nil
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKeys{client: clientset}, nil
+}
+
+// passphrase returns the passphrase of an encrypted volume from its key secret, or from the secret of the node
+// if the volume does not reference a key secret.
+func (k *encryptionKeys) passphrase(ctx context.Context, meta *metadata, cfg *Config) (string, error) {
+	ref := meta.EncryptionKeySecret
+	if ref == nil {
+		if cfg.EncryptionPassphrase == "" {
+			return "", fmt.Errorf("volume is encrypted with %s, %s missing in secret", meta.ClientEncryption, keyEncryptionPassphrase)
+		}
+		return cfg.EncryptionPassphrase, nil
+	}
+	if k == nil || k.client == nil {
+		return "", fmt.Errorf("key secret %s/%s can only be read if the driver runs in kubernetes", ref.Namespace, ref.Name)
+	}
+	secret, err := k.client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get key secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+	passphrase := string(secret.Data[keyEncryptionPassphrase])
+	if passphrase == "" {
+		return "", fmt.Errorf("key secret %s/%s has no %s", ref.Namespace, ref.Name, keyEncryptionPassphrase)
+	}
+	return passphrase, nil
+}
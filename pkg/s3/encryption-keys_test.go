@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_encryptionKeysPassphrase(t *testing.T) {
+	keys := &encryptionKeys{
+		client: fake.NewSimpleClientset(
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "data-encryption", Namespace: "team-a"},
+				Data:       map[string][]byte{keyEncryptionPassphrase: []byte("volume-key")},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "team-a"},
+			},
+		),
+	}
+	tests := []struct {
+		name    string
+		keys    *encryptionKeys
+		ref     *secretReference
+		cfg     *Config
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "key secret of the volume",
+			keys: keys,
+			ref:  &secretReference{Name: "data-encryption", Namespace: "team-a"},
+			cfg:  &Config{EncryptionPassphrase: "node-key"},
+			want: "volume-key",
+		},
+		{
+			name: "secret of the node",
+			keys: keys,
+			cfg:  &Config{EncryptionPassphrase: "node-key"},
+			want: "node-key",
+		},
+		{
+			name:    "missing in the secret of the node",
+			keys:    keys,
+			cfg:     &Config{},
+			wantErr: true,
+		},
+		{
+			name:    "key secret missing",
+			keys:    keys,
+			ref:     &secretReference{Name: "other", Namespace: "team-a"},
+			cfg:     &Config{EncryptionPassphrase: "node-key"},
+			wantErr: true,
+		},
+		{
+			name:    "key secret without passphrase",
+			keys:    keys,
+			ref:     &secretReference{Name: "empty", Namespace: "team-a"},
+			cfg:     &Config{EncryptionPassphrase: "node-key"},
+			wantErr: true,
+		},
+		{
+			name:    "key secret outside of kubernetes",
+			keys:    &encryptionKeys{},
+			ref:     &secretReference{Name: "data-encryption", Namespace: "team-a"},
+			cfg:     &Config{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &metadata{ClientEncryption: cseGocryptfs, EncryptionKeySecret: tt.ref}
+			got, err := tt.keys.passphrase(context.Background(), meta, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("passphrase() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("passphrase() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
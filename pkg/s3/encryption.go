@@ -0,0 +1,183 @@
+package s3
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// sseS3 encrypts objects with keys managed by the S3 backend
+	sseS3 = "sse-s3"
+	// sseKMS encrypts objects with a key stored in the KMS of the S3 backend
+	sseKMS = "sse-kms"
+	// sseC encrypts objects with a key provided by the client on every request
+	sseC = "sse-c"
+
+	sseCustomerKeyLength = 32
+
+	// cseGocryptfs encrypts all data on the node with gocryptfs before it is written to the bucket
+	cseGocryptfs = "gocryptfs"
+)
+
+// sseConfig describes the server-side encryption of a volume
+type sseConfig struct {
+	Type     string
+	KMSKeyID string
+}
+
+// parseSSEConfig returns the server-side encryption configured in the StorageClass parameters,
+// nil if no encryption was requested.
+func parseSSEConfig(params map[string]string) (*sseConfig, error) {
+	encryption := strings.ToLower(params[paramEncryption])
+	kmsKeyID := params[paramKMSKeyID]
+
+	switch encryption {
+	case "":
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("parameter %s requires %s to be %s", paramKMSKeyID, paramEncryption, sseKMS)
+		}
+		return nil, nil
+	case sseS3, sseC:
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("parameter %s requires %s to be %s", paramKMSKeyID, paramEncryption, sseKMS)
+		}
+		return &sseConfig{Type: encryption}, nil
+	case sseKMS:
+		if kmsKeyID == "" {
+			return nil, fmt.Errorf("encryption %s requires parameter %s", sseKMS, paramKMSKeyID)
+		}
+		return &sseConfig{Type: encryption, KMSKeyID: kmsKeyID}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption %q, must be one of %s, %s or %s", encryption, sseS3, sseKMS, sseC)
+	}
+}
+
+// parseClientEncryption returns the client-side encryption configured in the StorageClass parameters
+func parseClientEncryption(params map[string]string) (string, error) {
+	cse := strings.ToLower(params[paramClientEncryption])
+	switch cse {
+	case "", cseGocryptfs:
+		return cse, nil
+	default:
+		return "", fmt.Errorf("unsupported client-side encryption %q, must be %s", cse, cseGocryptfs)
+	}
+}
+
+// sseCustomerKey returns the decoded SSE-C key given in the secret
+func sseCustomerKey(cfg *Config) ([]byte, error) {
+	if cfg.SSECustomerKey == "" {
+		return nil, errors.New("encryption sse-c requires sseCustomerKey in secret")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.SSECustomerKey)
+	if err != nil {
+		return nil, fmt.Errorf("sseCustomerKey is not base64 encoded: %w", err)
+	}
+	if len(key) != sseCustomerKeyLength {
+		return nil, fmt.Errorf("sseCustomerKey must be %d bytes long, got %d", sseCustomerKeyLength, len(key))
+	}
+	return key, nil
+}
+
+func (s *sseConfig) equal(other *sseConfig) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return *s == *other
+}
+
+// serverSide returns the encryption which must be sent along with object uploads.
+// It is nil for sse-s3 and sse-kms, because these are applied as bucket default.
+func (s *sseConfig) serverSide(cfg *Config) (encrypt.ServerSide, error) {
+	if s == nil || s.Type != sseC {
+		return nil, nil
+	}
+	key, err := sseCustomerKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return encrypt.NewSSEC(key)
+}
+
+// secretReference is the secret which holds the passphrase of a volume encrypted on the client
+type secretReference struct {
+	Name      string
+	Namespace string
+}
+
+// secretPlaceholders maps the placeholders in a secretReference to the parameters added by the provisioner
+var (
+	secretPlaceholders = map[string]string{
+		"${pvc.name}":      paramPVCName,
+		"${pvc.namespace}": paramPVCNamespace,
+		"${pv.name}":       paramPVName,
+	}
+	placeholderRegex = regexp.MustCompile(`\$\{[^}]*\}`)
+)
+
+// parseEncryptionKeySecret returns the key secret configured in the StorageClass parameters with unresolved placeholders,
+// nil if the passphrase is taken from the secret of the node.
+func parseEncryptionKeySecret(params map[string]string, cse string) (*secretReference, error) {
+	name, namespace := params[paramEncryptionKeySecretName], params[paramEncryptionKeySecretNamespace]
+	if name == "" {
+		if namespace != "" {
+			return nil, fmt.Errorf("parameter %s requires %s", paramEncryptionKeySecretNamespace, paramEncryptionKeySecretName)
+		}
+		return nil, nil
+	}
+	if cse == "" {
+		return nil, fmt.Errorf("parameter %s requires %s", paramEncryptionKeySecretName, paramClientEncryption)
+	}
+	ref := &secretReference{Name: name, Namespace: namespace}
+	// the placeholders are only known per volume, validate the reference with sample values
+	sample := map[string]string{paramPVCName: "pvc", paramPVCNamespace: "default", paramPVName: "pv"}
+	if _, err := ref.resolve(sample); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// resolve replaces the placeholders with the parameters of the volume, the namespace defaults to the one of the PVC
+func (r *secretReference) resolve(params map[string]string) (*secretReference, error) {
+	namespace := r.Namespace
+	if namespace == "" {
+		namespace = "${pvc.namespace}"
+	}
+	name, err := expandPlaceholders(r.Name, params)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err = expandPlaceholders(namespace, params)
+	if err != nil {
+		return nil, err
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", paramEncryptionKeySecretName, name, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", paramEncryptionKeySecretNamespace, namespace, strings.Join(errs, ", "))
+	}
+	return &secretReference{Name: name, Namespace: namespace}, nil
+}
+
+func expandPlaceholders(s string, params map[string]string) (string, error) {
+	var err error
+	expanded := placeholderRegex.ReplaceAllStringFunc(s, func(placeholder string) string {
+		param, ok := secretPlaceholders[placeholder]
+		value := params[param]
+		switch {
+		case err != nil:
+		case !ok:
+			err = fmt.Errorf("unknown placeholder %s", placeholder)
+		case value == "":
+			err = fmt.Errorf("placeholder %s requires the provisioner to run with --extra-create-metadata", placeholder)
+		}
+		return value
+	})
+	return expanded, err
+}
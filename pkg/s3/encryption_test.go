@@ -0,0 +1,191 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseSSEConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *sseConfig
+		wantErr bool
+	}{
+		{
+			name:   "no encryption",
+			params: map[string]string{"mounter": "s3fs"},
+			want:   nil,
+		},
+		{
+			name:   "sse-s3",
+			params: map[string]string{"encryption": "SSE-S3"},
+			want:   &sseConfig{Type: sseS3},
+		},
+		{
+			name:   "sse-kms",
+			params: map[string]string{"encryption": "sse-kms", "kmsKeyID": "my-key"},
+			want:   &sseConfig{Type: sseKMS, KMSKeyID: "my-key"},
+		},
+		{
+			name:    "sse-kms without key",
+			params:  map[string]string{"encryption": "sse-kms"},
+			wantErr: true,
+		},
+		{
+			name:    "key without sse-kms",
+			params:  map[string]string{"encryption": "sse-c", "kmsKeyID": "my-key"},
+			wantErr: true,
+		},
+		{
+			name:   "sse-c",
+			params: map[string]string{"encryption": "sse-c"},
+			want:   &sseConfig{Type: sseC},
+		},
+		{
+			name:    "unknown",
+			params:  map[string]string{"encryption": "rot13"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSSEConfig(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSSEConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSSEConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sseCustomerKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{
+			name:    "missing",
+			key:     "",
+			wantErr: true,
+		},
+		{
+			name:    "not base64",
+			key:     "not-base64!",
+			wantErr: true,
+		},
+		{
+			name:    "too short",
+			key:     "c2hvcnQ=",
+			wantErr: true,
+		},
+		{
+			name: "valid",
+			key:  "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sseCustomerKey(&Config{SSECustomerKey: tt.key})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sseCustomerKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseEncryptionKeySecret(t *testing.T) {
+	volumeParams := map[string]string{
+		paramPVCName:      "data",
+		paramPVCNamespace: "team-a",
+		paramPVName:       "pvc-1",
+	}
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *secretReference
+		wantErr bool
+	}{
+		{
+			name:   "passphrase of the node",
+			params: map[string]string{paramClientEncryption: cseGocryptfs},
+		},
+		{
+			name: "templated name",
+			params: map[string]string{
+				paramClientEncryption:        cseGocryptfs,
+				paramEncryptionKeySecretName: "${pvc.name}-encryption",
+			},
+			want: &secretReference{Name: "data-encryption", Namespace: "team-a"},
+		},
+		{
+			name: "fixed namespace",
+			params: map[string]string{
+				paramClientEncryption:             cseGocryptfs,
+				paramEncryptionKeySecretName:      "key-${pv.name}",
+				paramEncryptionKeySecretNamespace: "keys",
+			},
+			want: &secretReference{Name: "key-pvc-1", Namespace: "keys"},
+		},
+		{
+			name: "without client-side encryption",
+			params: map[string]string{
+				paramEncryptionKeySecretName: "key",
+			},
+			wantErr: true,
+		},
+		{
+			name: "namespace without name",
+			params: map[string]string{
+				paramClientEncryption:             cseGocryptfs,
+				paramEncryptionKeySecretNamespace: "keys",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown placeholder",
+			params: map[string]string{
+				paramClientEncryption:        cseGocryptfs,
+				paramEncryptionKeySecretName: "${node.name}",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid name",
+			params: map[string]string{
+				paramClientEncryption:        cseGocryptfs,
+				paramEncryptionKeySecretName: "Key_${pvc.name}",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := parseEncryptionKeySecret(tt.params, tt.params[paramClientEncryption])
+			if err == nil && ref != nil {
+				ref, err = ref.resolve(volumeParams)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseEncryptionKeySecret() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(ref, tt.want) {
+				t.Errorf("parseEncryptionKeySecret() = %v, want %v", ref, tt.want)
+			}
+		})
+	}
+}
+
+func Test_secretReferenceResolveWithoutMetadata(t *testing.T) {
+	ref := &secretReference{Name: "${pvc.name}-encryption"}
+	if _, err := ref.resolve(map[string]string{}); err == nil {
+		t.Error("resolve() without --extra-create-metadata succeeded")
+	}
+}
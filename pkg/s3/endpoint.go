@@ -0,0 +1,178 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// Addressing styles of buckets
+const (
+	// addressingAuto uses virtual-host style for AWS, GCS and Aliyun OSS and path style for all others
+	addressingAuto    = "auto"
+	addressingPath    = "path"
+	addressingVirtual = "virtual"
+)
+
+// Signature versions of requests
+const (
+	signatureV2 = "v2"
+	signatureV4 = "v4"
+)
+
+// normalize validates the endpoint options and resolves their defaults,
+// so the s3Client and the mounters always use the same settings.
+func (cfg *Config) normalize() error {
+	if err := cfg.resolveEndpoint(); err != nil {
+		return err
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.AddressingStyle {
+	case "", addressingAuto:
+		cfg.AddressingStyle = addressingPath
+		if s3utils.IsVirtualHostSupported(*u, "") {
+			cfg.AddressingStyle = addressingVirtual
+		}
+	case addressingPath, addressingVirtual:
+	default:
+		return fmt.Errorf("unsupported addressingStyle %q, must be one of %s, %s or %s", cfg.AddressingStyle, addressingAuto, addressingPath, addressingVirtual)
+	}
+
+	switch cfg.SignatureVersion {
+	case "":
+		cfg.SignatureVersion = signatureV4
+	case signatureV2, signatureV4:
+	default:
+		return fmt.Errorf("unsupported signatureVersion %q, must be %s or %s", cfg.SignatureVersion, signatureV2, signatureV4)
+	}
+
+	if cfg.HTTPProxy != "" {
+		p, err := url.Parse(cfg.HTTPProxy)
+		if err != nil || p.Host == "" {
+			return fmt.Errorf("invalid httpProxy %q", redactURL(cfg.HTTPProxy))
+		}
+	}
+	return nil
+}
+
+// resolveEndpoint sets the AWS endpoint of the region if no endpoint is given,
+// and the region of AWS endpoints if no region is given.
+func (cfg *Config) resolveEndpoint() error {
+	if cfg.Endpoint == "" {
+		if cfg.Region == "" {
+			return errors.New("either endpoint or region is required")
+		}
+		cfg.Endpoint = "https://" + awsEndpoint(cfg.Region, cfg.UseFIPS, cfg.UseDualStack)
+		return nil
+	}
+	if cfg.UseFIPS || cfg.UseDualStack {
+		return errors.New("useFIPS and useDualStack can only be used without endpoint")
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", cfg.Endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q, must be an URL like https://s3.example.com", cfg.Endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid endpoint %q, must not contain a query or fragment", cfg.Endpoint)
+	}
+	if cfg.Region == "" && s3utils.IsAmazonEndpoint(*u) {
+		cfg.Region = s3utils.GetRegionFromURL(*u)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	cfg.Endpoint = u.String()
+	return nil
+}
+
+// awsEndpoint returns the host of the S3 endpoint of an AWS region
+func awsEndpoint(region string, fips, dualStack bool) string {
+	host := "s3"
+	if fips {
+		host += "-fips"
+	}
+	if dualStack {
+		host += ".dualstack"
+	}
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("%s.%s.%s", host, region, domain)
+}
+
+// minioEndpoint returns the host and the path prefix of the endpoint as minio-go expects them
+func (cfg *Config) minioEndpoint() (host string, secure bool, pathPrefix string, err error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return "", false, "", err
+	}
+	return u.Host, u.Scheme == "https", u.Path, nil
+}
+
+// pathPrefixTransport sends all requests to a gateway which serves the S3 API below a path.
+// The gateway strips the prefix, so it must not be part of the signature. s3fs behaves the same,
+// it requests the objects below the path of its url but signs only the path of the bucket and the object.
+type pathPrefixTransport struct {
+	prefix string
+	base   http.RoundTripper
+}
+
+func (t *pathPrefixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Path = t.prefix + req.URL.Path
+	if req.URL.RawPath != "" {
+		r.URL.RawPath = t.prefix + req.URL.RawPath
+	}
+	return t.base.RoundTrip(r)
+}
+
+func (cfg *Config) bucketLookup() minio.BucketLookupType {
+	if cfg.AddressingStyle == addressingVirtual {
+		return minio.BucketLookupDNS
+	}
+	return minio.BucketLookupPath
+}
+
+// proxy returns the proxy of the transport, the proxy from the environment is used if none is configured
+func (cfg *Config) proxy() func(*http.Request) (*url.URL, error) {
+	if cfg.HTTPProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	p, _ := url.Parse(cfg.HTTPProxy)
+	return http.ProxyURL(p)
+}
+
+// signatureProvider signs all requests with the configured signature version, regardless of the credentials provider
+type signatureProvider struct {
+	credentials.Provider
+	signerType credentials.SignatureType
+}
+
+func (p *signatureProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.Provider.Retrieve()
+	if err != nil || value.SignerType.IsAnonymous() {
+		return value, err
+	}
+	value.SignerType = p.signerType
+	return value, nil
+}
+
+func (cfg *Config) signerType() credentials.SignatureType {
+	if cfg.SignatureVersion == signatureV2 {
+		return credentials.SignatureV2
+	}
+	return credentials.SignatureV4
+}
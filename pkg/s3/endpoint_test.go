@@ -0,0 +1,265 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_normalize(t *testing.T) {
+	tests := []struct {
+		name           string
+		cfg            *Config
+		wantAddressing string
+		wantSignature  string
+		wantErr        bool
+	}{
+		{
+			name:           "defaults for aws",
+			cfg:            &Config{Endpoint: "https://s3.eu-central-1.amazonaws.com"},
+			wantAddressing: addressingVirtual,
+			wantSignature:  signatureV4,
+		},
+		{
+			name:           "defaults for other providers",
+			cfg:            &Config{Endpoint: "http://127.0.0.1:9000"},
+			wantAddressing: addressingPath,
+			wantSignature:  signatureV4,
+		},
+		{
+			name:           "explicit virtual-host and v2",
+			cfg:            &Config{Endpoint: "https://s3.example.com", AddressingStyle: "virtual", SignatureVersion: "v2"},
+			wantAddressing: addressingVirtual,
+			wantSignature:  signatureV2,
+		},
+		{
+			name:    "unknown addressing style",
+			cfg:     &Config{Endpoint: "https://s3.example.com", AddressingStyle: "dns"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown signature version",
+			cfg:     &Config{Endpoint: "https://s3.example.com", SignatureVersion: "v3"},
+			wantErr: true,
+		},
+		{
+			name:           "proxy",
+			cfg:            &Config{Endpoint: "https://s3.example.com", HTTPProxy: "http://proxy.example.com:3128"},
+			wantAddressing: addressingPath,
+			wantSignature:  signatureV4,
+		},
+		{
+			name:    "invalid proxy",
+			cfg:     &Config{Endpoint: "https://s3.example.com", HTTPProxy: "proxy"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.normalize()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("normalize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.cfg.AddressingStyle != tt.wantAddressing {
+				t.Errorf("normalize() AddressingStyle = %v, want %v", tt.cfg.AddressingStyle, tt.wantAddressing)
+			}
+			if tt.cfg.SignatureVersion != tt.wantSignature {
+				t.Errorf("normalize() SignatureVersion = %v, want %v", tt.cfg.SignatureVersion, tt.wantSignature)
+			}
+		})
+	}
+}
+
+func Test_resolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		cfg            *Config
+		wantHost       string
+		wantSecure     bool
+		wantPathPrefix string
+		wantRegion     string
+		wantS3fsArgs   []string
+		wantErr        bool
+	}{
+		{
+			name:         "aws region only",
+			cfg:          &Config{Region: "eu-central-1"},
+			wantHost:     "s3.eu-central-1.amazonaws.com",
+			wantSecure:   true,
+			wantRegion:   "eu-central-1",
+			wantS3fsArgs: []string{"url=https://s3.eu-central-1.amazonaws.com", "endpoint=eu-central-1"},
+		},
+		{
+			name:         "aws regional endpoint without region",
+			cfg:          &Config{Endpoint: "https://s3.us-west-2.amazonaws.com/"},
+			wantHost:     "s3.us-west-2.amazonaws.com",
+			wantSecure:   true,
+			wantRegion:   "us-west-2",
+			wantS3fsArgs: []string{"url=https://s3.us-west-2.amazonaws.com", "endpoint=us-west-2"},
+		},
+		{
+			name:       "aws fips",
+			cfg:        &Config{Region: "us-east-1", UseFIPS: true},
+			wantHost:   "s3-fips.us-east-1.amazonaws.com",
+			wantSecure: true,
+			wantRegion: "us-east-1",
+		},
+		{
+			name:       "aws dualstack",
+			cfg:        &Config{Region: "eu-west-1", UseDualStack: true},
+			wantHost:   "s3.dualstack.eu-west-1.amazonaws.com",
+			wantSecure: true,
+			wantRegion: "eu-west-1",
+		},
+		{
+			name:       "aws china",
+			cfg:        &Config{Region: "cn-north-1"},
+			wantHost:   "s3.cn-north-1.amazonaws.com.cn",
+			wantSecure: true,
+			wantRegion: "cn-north-1",
+		},
+		{
+			name:         "minio without region",
+			cfg:          &Config{Endpoint: "http://minio.example.com:9000"},
+			wantHost:     "minio.example.com:9000",
+			wantRegion:   "",
+			wantS3fsArgs: []string{"url=http://minio.example.com:9000", "use_path_request_style"},
+		},
+		{
+			name:         "ceph with region",
+			cfg:          &Config{Endpoint: "https://rgw.example.com", Region: "default"},
+			wantHost:     "rgw.example.com",
+			wantSecure:   true,
+			wantRegion:   "default",
+			wantS3fsArgs: []string{"url=https://rgw.example.com", "endpoint=default", "use_path_request_style"},
+		},
+		{
+			name:           "gateway with path prefix",
+			cfg:            &Config{Endpoint: "https://gateway.example.com/s3/"},
+			wantHost:       "gateway.example.com",
+			wantSecure:     true,
+			wantPathPrefix: "/s3",
+			wantS3fsArgs:   []string{"url=https://gateway.example.com/s3", "use_path_request_style"},
+		},
+		{
+			name:    "neither endpoint nor region",
+			cfg:     &Config{},
+			wantErr: true,
+		},
+		{
+			name:    "fips with endpoint",
+			cfg:     &Config{Endpoint: "https://s3.example.com", UseFIPS: true},
+			wantErr: true,
+		},
+		{
+			name:    "endpoint without scheme",
+			cfg:     &Config{Endpoint: "s3.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "endpoint with query",
+			cfg:     &Config{Endpoint: "https://s3.example.com?bucket=a"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.normalize()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("normalize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			host, secure, pathPrefix, err := tt.cfg.minioEndpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.wantHost || secure != tt.wantSecure || pathPrefix != tt.wantPathPrefix {
+				t.Errorf("minioEndpoint() = %v, %v, %v, want %v, %v, %v", host, secure, pathPrefix, tt.wantHost, tt.wantSecure, tt.wantPathPrefix)
+			}
+			if tt.cfg.Region != tt.wantRegion {
+				t.Errorf("normalize() Region = %v, want %v", tt.cfg.Region, tt.wantRegion)
+			}
+			if tt.wantS3fsArgs == nil {
+				return
+			}
+			mounter := newMounter(&metadata{Name: "bucket", FSPath: "csi-fs"}, tt.cfg, nil, stateDir(t.TempDir())).(*s3fsMounter)
+			args, _, err := mounter.mountArgs("/target")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var options []string
+			for i, arg := range args {
+				if arg == "-o" && args[i+1] != "allow_other" && args[i+1] != "mp_umask=000" {
+					options = append(options, args[i+1])
+				}
+			}
+			if strings.Join(options, " ") != strings.Join(tt.wantS3fsArgs, " ") {
+				t.Errorf("mountArgs() options = %v, want %v", options, tt.wantS3fsArgs)
+			}
+		})
+	}
+}
+
+func Test_pathPrefixTransport(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &pathPrefixTransport{prefix: "/s3", base: http.DefaultTransport}}
+	resp, err := client.Get(server.URL + "/bucket/csi-fs/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotPath != "/s3/bucket/csi-fs/metadata.json" {
+		t.Errorf("pathPrefixTransport path = %v, want /s3/bucket/csi-fs/metadata.json", gotPath)
+	}
+}
+
+// Test_pathPrefixMounter checks that s3fs is given the same prefix the driver sends its requests below.
+// Both sign the path of the bucket and the object without the prefix, see pathPrefixTransport.
+func Test_pathPrefixMounter(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer server.Close()
+
+	cfg := &Config{AccessKeyID: "access", SecretAccessKey: "secret", Endpoint: server.URL + "/s3/", Region: "us-east-1"}
+	client, err := newS3Client(cfg, newTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.minio.BucketExists(context.Background(), "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/s3/bucket/" {
+		t.Errorf("request path = %v, want /s3/bucket/", gotPath)
+	}
+
+	mounter := newMounter(&metadata{Name: "bucket", FSPath: "csi-fs"}, client.cfg, nil, stateDir(t.TempDir())).(*s3fsMounter)
+	args, _, err := mounter.mountArgs("/target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := strings.Join(args, " ")
+	// s3fs appends /<bucket>/<object> to the url with path style requests
+	for _, want := range []string{"url=" + server.URL + "/s3", "use_path_request_style"} {
+		if !strings.Contains(options, "-o "+want+" ") && !strings.HasSuffix(options, "-o "+want) {
+			t.Errorf("mountArgs() = %v, want option %s", args, want)
+		}
+	}
+}
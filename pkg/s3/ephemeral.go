@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// contextEphemeral is set by kubelet in the volume context of inline volumes of a pod if the CSIDriver has podInfoOnMount
+const contextEphemeral = "csi.storage.k8s.io/ephemeral"
+
+// Volume attributes of inline volumes, the bucket must exist, it is neither created nor deleted by the driver
+const (
+	attrBucket = "bucket"
+	attrPath   = "path"
+)
+
+// isEphemeral returns true for inline volumes which are only published on the node
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[contextEphemeral] == "true"
+}
+
+// ephemeralMetadata returns the metadata of an inline volume from its volume attributes,
+// inline volumes have no metadata stored by the controller
+func ephemeralMetadata(attributes map[string]string) (*metadata, error) {
+	bucket := attributes[attrBucket]
+	if bucket == "" {
+		return nil, fmt.Errorf("inline volumes require the volume attribute %s", attrBucket)
+	}
+	if err := s3utils.CheckValidBucketName(bucket); err != nil {
+		return nil, fmt.Errorf("invalid volume attribute %s: %w", attrBucket, err)
+	}
+	path := strings.Trim(attributes[attrPath], "/")
+	mounter, err := parseMounter(attributes[paramMounter])
+	if err != nil {
+		return nil, err
+	}
+	sse, err := parseSSEConfig(attributes)
+	if err != nil {
+		return nil, err
+	}
+	cse, err := parseClientEncryption(attributes)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata{
+		Version:          metadataVersion,
+		Name:             bucket,
+		FSPath:           path,
+		Mounter:          mounter,
+		SSE:              sse,
+		ClientEncryption: cse,
+	}, nil
+}
+
+// ephemeralSecrets returns the secrets of an inline volume, the credentials must be in the nodePublishSecretRef.
+// Only the static credentials are used, the pod must not mount buckets with the credentials of the node.
+func ephemeralSecrets(secrets map[string]string) (map[string]string, error) {
+	if secrets["accessKeyID"] == "" || secrets["secretAccessKey"] == "" {
+		return nil, fmt.Errorf("inline volumes require accessKeyID and secretAccessKey in the nodePublishSecretRef")
+	}
+	static := make(map[string]string, len(secrets)+1)
+	for k, v := range secrets {
+		static[k] = v
+	}
+	static["credentialsChain"] = credentialsStatic
+	return static, nil
+}
+
+// ephemeralVolume returns the metadata of an inline volume and makes sure its bucket exists
+func ephemeralVolume(ctx context.Context, client *s3Client, attributes map[string]string) (*metadata, error) {
+	meta, err := ephemeralMetadata(attributes)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	exists, err := client.bucketExists(ctx, meta.Name)
+	if err != nil {
+		return nil, statusError(err, "failed to check if bucket %s exists", meta.Name)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "bucket %s of the inline volume does not exist", meta.Name)
+	}
+	return meta, nil
+}
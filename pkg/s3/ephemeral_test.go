@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_ephemeralMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       *metadata
+		wantErr    bool
+	}{
+		{
+			name:       "bucket",
+			attributes: map[string]string{contextEphemeral: "true", attrBucket: "reference-data"},
+			want:       &metadata{Version: metadataVersion, Name: "reference-data"},
+		},
+		{
+			name: "path and encryption",
+			attributes: map[string]string{
+				attrBucket:            "reference-data",
+				attrPath:              "/datasets/2024/",
+				paramMounter:          mounterS3fs,
+				paramEncryption:       sseKMS,
+				paramKMSKeyID:         "key-1",
+				paramClientEncryption: cseGocryptfs,
+			},
+			want: &metadata{
+				Version:          metadataVersion,
+				Name:             "reference-data",
+				FSPath:           "datasets/2024",
+				Mounter:          mounterS3fs,
+				SSE:              &sseConfig{Type: sseKMS, KMSKeyID: "key-1"},
+				ClientEncryption: cseGocryptfs,
+			},
+		},
+		{
+			name:       "bucket missing",
+			attributes: map[string]string{contextEphemeral: "true"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid bucket",
+			attributes: map[string]string{attrBucket: "ab"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid mounter",
+			attributes: map[string]string{attrBucket: "reference-data", paramMounter: "goofys"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ephemeralMetadata(tt.attributes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ephemeralMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ephemeralMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ephemeralSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "static credentials",
+			secrets: map[string]string{"accessKeyID": "key", "secretAccessKey": "secret", "endpoint": "https://s3.example.com"},
+			want:    map[string]string{"accessKeyID": "key", "secretAccessKey": "secret", "endpoint": "https://s3.example.com", "credentialsChain": credentialsStatic},
+		},
+		{
+			name:    "credentials of the node are not used",
+			secrets: map[string]string{"accessKeyID": "key", "secretAccessKey": "secret", "credentialsChain": "iam,static"},
+			want:    map[string]string{"accessKeyID": "key", "secretAccessKey": "secret", "credentialsChain": credentialsStatic},
+		},
+		{
+			name:    "no secret",
+			wantErr: true,
+		},
+		{
+			name:    "secret access key missing",
+			secrets: map[string]string{"accessKeyID": "key", "credentialsChain": credentialsIAM},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ephemeralSecrets(tt.secrets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ephemeralSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ephemeralSecrets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nodePublishEphemeralWithoutSecret(t *testing.T) {
+	ns := &nodeServer{volumeLocks: newVolumeLocks()}
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "csi-inline-1",
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{contextEphemeral: "true", attrBucket: "reference-data"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodePublishVolume() error = %v, want InvalidArgument", err)
+	}
+}
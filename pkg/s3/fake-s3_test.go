@@ -0,0 +1,449 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/madmin-go/v3"
+)
+
+// fakeSecretKey is the secret key of the clients of the fake, the admin API encrypts with it
+const fakeSecretKey = "secret-key-of-the-test"
+
+// fakeS3 is an in-memory S3 backend which understands the path style requests of the s3Client
+// and the service account calls of the MinIO admin API
+type fakeS3 struct {
+	lock    sync.Mutex
+	buckets map[string]*fakeBucket
+	// serviceAccounts are the requests which created the service accounts by access key
+	serviceAccounts map[string]madmin.AddServiceAccountReq
+	// versions counts the object versions to give them unique ids
+	versions int
+	// fail returns the error code a request is answered with, no error if empty
+	fail func(r *http.Request) string
+}
+
+type fakeBucket struct {
+	created    time.Time
+	objectLock bool
+	versioning bool
+	// subresources holds the configuration put with ?tagging, ?lifecycle, ?encryption and ?object-lock
+	subresources map[string][]byte
+	// objects holds all versions and delete markers, the latest version of a key is the last one
+	objects []*fakeObject
+}
+
+type fakeObject struct {
+	key          string
+	versionID    string
+	deleteMarker bool
+	data         []byte
+	modified     time.Time
+}
+
+// startFakeS3 serves the fake S3 backend until the test ends and returns the secrets of a client
+func startFakeS3(t *testing.T, fake *fakeS3) map[string]string {
+	t.Helper()
+	if fake.buckets == nil {
+		fake.buckets = map[string]*fakeBucket{}
+	}
+	if fake.serviceAccounts == nil {
+		fake.serviceAccounts = map[string]madmin.AddServiceAccountReq{}
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return map[string]string{
+		"accessKeyID":     "access",
+		"secretAccessKey": fakeSecretKey,
+		"endpoint":        server.URL,
+		"region":          "us-east-1",
+		"addressingStyle": addressingPath,
+	}
+}
+
+// newFakeS3Client returns a client of a new fake S3 backend
+func newFakeS3Client(t *testing.T, fake *fakeS3) *s3Client {
+	t.Helper()
+	cfg, err := configFromSecrets(startFakeS3(t, fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newS3Client(cfg, newTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// bucket returns the bucket for assertions in tests, nil if it does not exist
+func (f *fakeS3) bucket(name string) *fakeBucket {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.buckets[name]
+}
+
+// latest returns the latest version of key, nil if it does not exist or is deleted
+func (b *fakeBucket) latest(key string) *fakeObject {
+	for i := len(b.objects) - 1; i >= 0; i-- {
+		if o := b.objects[i]; o.key == key {
+			if o.deleteMarker {
+				return nil
+			}
+			return o
+		}
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.fail != nil {
+		if code := f.fail(r); code != "" {
+			// not a server error, the client would retry it
+			status := http.StatusBadRequest
+			if code == "NotImplemented" {
+				status = http.StatusNotImplemented
+			}
+			writeS3Error(w, r, status, code)
+			return
+		}
+	}
+	if admin, ok := strings.CutPrefix(r.URL.Path, "/minio/admin/v3/"); ok {
+		f.serveAdmin(w, r, admin)
+		return
+	}
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucketName == "" {
+		f.listBuckets(w)
+		return
+	}
+	if r.Method == http.MethodPut && key == "" && len(r.URL.Query()) == 0 {
+		f.createBucket(w, r, bucketName)
+		return
+	}
+	bucket, ok := f.buckets[bucketName]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key != "" {
+		f.serveObject(w, r, bucket, key)
+		return
+	}
+	f.serveBucket(w, r, bucketName, bucket)
+}
+
+func (f *fakeS3) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name         string
+		CreationDate time.Time
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{}
+	for name, b := range f.buckets {
+		result.Buckets = append(result.Buckets, bucket{Name: name, CreationDate: b.created})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+	writeXML(w, result)
+}
+
+func (f *fakeS3) createBucket(w http.ResponseWriter, r *http.Request, name string) {
+	if _, ok := f.buckets[name]; ok {
+		writeS3Error(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou")
+		return
+	}
+	objectLock := r.Header.Get("X-Amz-Bucket-Object-Lock-Enabled") == "true"
+	f.buckets[name] = &fakeBucket{
+		created:      time.Now(),
+		objectLock:   objectLock,
+		versioning:   objectLock,
+		subresources: map[string][]byte{},
+	}
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, name string, bucket *fakeBucket) {
+	query := r.URL.Query()
+	for _, sub := range []string{"tagging", "lifecycle", "encryption", "object-lock"} {
+		if !query.Has(sub) {
+			continue
+		}
+		switch r.Method {
+		case http.MethodPut:
+			if sub == "object-lock" && !bucket.objectLock {
+				writeS3Error(w, r, http.StatusConflict, "InvalidBucketState")
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			bucket.subresources[sub] = body
+		case http.MethodDelete:
+			delete(bucket.subresources, sub)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			body, ok := bucket.subresources[sub]
+			if !ok {
+				notFound := map[string]string{
+					"tagging":     "NoSuchTagSet",
+					"lifecycle":   "NoSuchLifecycleConfiguration",
+					"encryption":  "ServerSideEncryptionConfigurationNotFoundError",
+					"object-lock": "ObjectLockConfigurationNotFoundError",
+				}
+				writeS3Error(w, r, http.StatusNotFound, notFound[sub])
+				return
+			}
+			_, _ = w.Write(body)
+		}
+		return
+	}
+	switch {
+	case query.Has("versioning") && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		bucket.versioning = strings.Contains(string(body), "Enabled")
+	case query.Has("versioning"):
+		status := "Suspended"
+		if bucket.versioning {
+			status = "Enabled"
+		}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"VersioningConfiguration"`
+			Status  string
+		}{Status: status})
+	case query.Has("versions"):
+		f.listVersions(w, name, bucket)
+	case query.Has("delete") && r.Method == http.MethodPost:
+		f.deleteObjects(w, r, bucket)
+	case r.Method == http.MethodDelete:
+		if len(bucket.objects) > 0 {
+			writeS3Error(w, r, http.StatusConflict, "BucketNotEmpty")
+			return
+		}
+		delete(f.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) listVersions(w http.ResponseWriter, name string, bucket *fakeBucket) {
+	type version struct {
+		XMLName      xml.Name
+		Key          string
+		VersionID    string `xml:"VersionId"`
+		IsLatest     bool
+		LastModified time.Time
+		Size         int64 `xml:",omitempty"`
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListVersionsResult"`
+		Name     string
+		Versions []version
+	}{Name: name}
+	// newest first per key like S3
+	for i := len(bucket.objects) - 1; i >= 0; i-- {
+		o := bucket.objects[i]
+		element := "Version"
+		if o.deleteMarker {
+			element = "DeleteMarker"
+		}
+		latest := true
+		for _, newer := range bucket.objects[i+1:] {
+			latest = latest && newer.key != o.key
+		}
+		result.Versions = append(result.Versions, version{
+			XMLName:      xml.Name{Local: element},
+			Key:          o.key,
+			VersionID:    o.versionID,
+			IsLatest:     latest,
+			LastModified: o.modified,
+			Size:         int64(len(o.data)),
+		})
+	}
+	sort.SliceStable(result.Versions, func(i, j int) bool { return result.Versions[i].Key < result.Versions[j].Key })
+	writeXML(w, result)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request, bucket *fakeBucket) {
+	var req struct {
+		Objects []struct {
+			Key       string
+			VersionID string `xml:"VersionId"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	type deleted struct {
+		Key       string
+		VersionID string `xml:"VersionId,omitempty"`
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, o := range req.Objects {
+		f.deleteObject(bucket, o.Key, o.VersionID)
+		result.Deleted = append(result.Deleted, deleted{Key: o.Key, VersionID: o.VersionID})
+	}
+	writeXML(w, result)
+}
+
+// deleteObject removes a version, without version a delete marker is added to a versioned bucket
+func (f *fakeS3) deleteObject(bucket *fakeBucket, key, versionID string) {
+	if versionID == "" && bucket.versioning {
+		f.versions++
+		bucket.objects = append(bucket.objects, &fakeObject{
+			key:          key,
+			versionID:    fmt.Sprintf("v%d", f.versions),
+			deleteMarker: true,
+			modified:     time.Now(),
+		})
+		return
+	}
+	if versionID == "" {
+		versionID = "null"
+	}
+	objects := bucket.objects[:0]
+	for _, o := range bucket.objects {
+		if o.key != key || o.versionID != versionID {
+			objects = append(objects, o)
+		}
+	}
+	bucket.objects = objects
+}
+
+func (f *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, bucket *fakeBucket, key string) {
+	switch r.Method {
+	case http.MethodPut:
+		data := readPayload(r)
+		versionID := "null"
+		if bucket.versioning {
+			f.versions++
+			versionID = fmt.Sprintf("v%d", f.versions)
+		} else {
+			f.deleteObject(bucket, key, versionID)
+		}
+		bucket.objects = append(bucket.objects, &fakeObject{key: key, versionID: versionID, data: data, modified: time.Now()})
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodDelete:
+		f.deleteObject(bucket, key, r.URL.Query().Get("versionId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		o := bucket.latest(key)
+		if o == nil {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(o.data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(o.data)
+		}
+	}
+}
+
+func (f *fakeS3) serveAdmin(w http.ResponseWriter, r *http.Request, api string) {
+	accessKey := r.URL.Query().Get("accessKey")
+	switch api {
+	case "add-service-account":
+		data, err := madmin.DecryptData(fakeSecretKey, r.Body)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "XMinioAdminConfigBadJSON")
+			return
+		}
+		var req madmin.AddServiceAccountReq
+		if err := json.Unmarshal(data, &req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "XMinioAdminConfigBadJSON")
+			return
+		}
+		if _, ok := f.serviceAccounts[req.AccessKey]; ok {
+			writeAdminError(w, http.StatusConflict, "XMinioAdminServiceAccountAlreadyExists")
+			return
+		}
+		f.serviceAccounts[req.AccessKey] = req
+		writeAdminResponse(w, madmin.AddServiceAccountResp{
+			Credentials: madmin.Credentials{AccessKey: req.AccessKey, SecretKey: req.SecretKey},
+		})
+	case "info-service-account":
+		req, ok := f.serviceAccounts[accessKey]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, minioServiceAccountNotFound)
+			return
+		}
+		writeAdminResponse(w, madmin.InfoServiceAccountResp{Name: req.Name, Policy: string(req.Policy)})
+	case "delete-service-account":
+		if _, ok := f.serviceAccounts[accessKey]; !ok {
+			writeAdminError(w, http.StatusNotFound, minioServiceAccountNotFound)
+			return
+		}
+		delete(f.serviceAccounts, accessKey)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeAdminResponse(w http.ResponseWriter, v any) {
+	data, _ := json.Marshal(v)
+	encrypted, _ := madmin.EncryptData(fakeSecretKey, data)
+	_, _ = io.Copy(w, bytes.NewReader(encrypted))
+}
+
+func writeAdminError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(madmin.ErrorResponse{Code: code, Message: code})
+}
+
+// readPayload returns the body of a request, minio-go uploads in signed chunks over plain HTTP
+func readPayload(r *http.Request) []byte {
+	body, _ := io.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return body
+	}
+	var data []byte
+	for len(body) > 0 {
+		header, rest, _ := strings.Cut(string(body), "\r\n")
+		sizeHex, _, _ := strings.Cut(header, ";")
+		var size int
+		if _, err := fmt.Sscanf(sizeHex, "%x", &size); err != nil || size == 0 || size > len(rest) {
+			break
+		}
+		data = append(data, rest[:size]...)
+		body = []byte(strings.TrimPrefix(rest[size:], "\r\n"))
+	}
+	return data
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	gocryptfsCmd = "gocryptfs"
+	// gocryptfsConfig is created in the ciphertext directory by gocryptfs -init
+	gocryptfsConfig = "gocryptfs.conf"
+)
+
+// Implements Mounter, encrypts all data on the client before it is written to the bucket
+type gocryptfsMounter struct {
+	// backend mounts the bucket which holds the ciphertext
+	backend    Mounter
+	passphrase string
+	// options are passed with -o to the kernel
+	options []string
+	// stateDir holds the passphrase file and the mount of the bucket
+	stateDir stateDir
+}
+
+func (g *gocryptfsMounter) Stage(ctx context.Context, stageTarget string) error {
+	return g.backend.Stage(ctx, stageTarget)
+}
+
+func (g *gocryptfsMounter) Unstage(ctx context.Context, stageTarget string) error {
+	return g.backend.Unstage(ctx, stageTarget)
+}
+
+func (g *gocryptfsMounter) Mount(ctx context.Context, source string, target string) error {
+	if g.passphrase == "" {
+		return fmt.Errorf("volume is encrypted with %s but no %s is given", gocryptfsCmd, keyEncryptionPassphrase)
+	}
+	cipherDir := g.stateDir.ciphertextDir(target)
+	if err := os.MkdirAll(cipherDir, 0700); err != nil {
+		return err
+	}
+	if err := g.backend.Mount(ctx, source, cipherDir); err != nil {
+		return err
+	}
+	if err := g.mountPlaintext(ctx, cipherDir, target); err != nil {
+		// the bucket must not stay mounted below the state of target if the volume is not usable
+		if uerr := g.backend.Unmount(ctx, cipherDir); uerr != nil {
+			return errors.Join(err, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unmount unmounts the plaintext at target and the bucket below it
+func (g *gocryptfsMounter) Unmount(ctx context.Context, target string) error {
+	if err := fuseUnmount(target); err != nil {
+		return err
+	}
+	return g.backend.Unmount(ctx, g.stateDir.ciphertextDir(target))
+}
+
+// mountPlaintext initializes the encryption of a new volume and mounts the plaintext of cipherDir at target
+func (g *gocryptfsMounter) mountPlaintext(ctx context.Context, cipherDir, target string) error {
+	passFile, err := g.stateDir.writeMountFile(target, "gocryptfs.pass", g.passphrase)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(cipherDir, gocryptfsConfig))
+	if os.IsNotExist(err) {
+		debugLogger(ctx).Info("Initializing encryption", "cipherDir", cipherDir)
+		out, err := exec.Command(gocryptfsCmd, "-init", "-quiet", "-passfile", passFile, cipherDir).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to initialize encryption of %q output:%s err:%w", cipherDir, string(out), err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return fuseMount(ctx, gocryptfsCmd, g.mountArgs(ctx, passFile, cipherDir, target), nil)
+}
+
+// mountArgs returns the arguments of gocryptfs
+func (g *gocryptfsMounter) mountArgs(ctx context.Context, passFile, cipherDir, target string) []string {
+	args := []string{
+		"-quiet",
+		"-allow_other",
+		"-passfile", passFile,
+	}
+	if volumeDebug(ctx) {
+		args = append(args, "-d")
+	}
+	for _, opt := range g.options {
+		args = append(args, "-o", opt)
+	}
+	return append(args, cipherDir, target)
+}
+
+// ciphertextDir returns the directory where the bucket of an encrypted volume mounted at target is mounted to
+func (d stateDir) ciphertextDir(target string) string {
+	return filepath.Join(d.mountDir(target), "ciphertext")
+}
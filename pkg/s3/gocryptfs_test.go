@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeMounter records the mounts of the backend of a gocryptfsMounter
+type fakeMounter struct {
+	mounted   []string
+	unmounted []string
+}
+
+func (f *fakeMounter) Stage(ctx context.Context, stagePath string) error   { return nil }
+func (f *fakeMounter) Unstage(ctx context.Context, stagePath string) error { return nil }
+
+func (f *fakeMounter) Mount(ctx context.Context, source string, target string) error {
+	f.mounted = append(f.mounted, target)
+	return nil
+}
+
+func (f *fakeMounter) Unmount(ctx context.Context, target string) error {
+	f.unmounted = append(f.unmounted, target)
+	return nil
+}
+
+func Test_gocryptfsMountArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		debug   bool
+		want    []string
+	}{
+		{
+			name: "defaults",
+			want: []string{"-quiet", "-allow_other", "-passfile", "/state/gocryptfs.pass", "/state/ciphertext", "/target"},
+		},
+		{
+			name:    "options and debug",
+			options: []string{"ro", "noexec"},
+			debug:   true,
+			want: []string{
+				"-quiet", "-allow_other", "-passfile", "/state/gocryptfs.pass", "-d",
+				"-o", "ro", "-o", "noexec", "/state/ciphertext", "/target",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			g := &gocryptfsMounter{backend: &fakeMounter{}, passphrase: "secret", options: tt.options}
+			ctx := withVolumeDebug(context.Background(), tt.debug)
+			got := g.mountArgs(ctx, "/state/gocryptfs.pass", "/state/ciphertext", "/target")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mountArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_gocryptfsMount(t *testing.T) {
+	tests := []struct {
+		name          string
+		passphrase    string
+		initialized   bool
+		wantMounted   bool
+		wantUnmounted bool
+	}{
+		{
+			name: "missing passphrase",
+		},
+		{
+			name:          "init fails",
+			passphrase:    "secret",
+			wantMounted:   true,
+			wantUnmounted: true,
+		},
+		{
+			name:          "mount fails",
+			passphrase:    "secret",
+			initialized:   true,
+			wantMounted:   true,
+			wantUnmounted: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// gocryptfs can not be found, so initialization and mount fail
+			t.Setenv("PATH", t.TempDir())
+			target := filepath.Join(t.TempDir(), "target")
+			dir := stateDir(t.TempDir())
+			if tt.initialized {
+				if err := os.MkdirAll(dir.ciphertextDir(target), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir.ciphertextDir(target), gocryptfsConfig), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			backend := &fakeMounter{}
+			g := &gocryptfsMounter{backend: backend, passphrase: tt.passphrase, stateDir: dir}
+			if err := g.Mount(context.Background(), "/staging", target); err == nil {
+				t.Fatal("Mount() succeeded without gocryptfs")
+			}
+			if got := len(backend.mounted) > 0; got != tt.wantMounted {
+				t.Errorf("backend mounted = %v, want %v", got, tt.wantMounted)
+			}
+			if tt.wantUnmounted && !reflect.DeepEqual(backend.unmounted, []string{dir.ciphertextDir(target)}) {
+				t.Errorf("backend unmounted = %v, want %v", backend.unmounted, []string{dir.ciphertextDir(target)})
+			}
+			if !tt.wantUnmounted && len(backend.unmounted) > 0 {
+				t.Errorf("backend unmounted = %v, want none", backend.unmounted)
+			}
+		})
+	}
+}
@@ -17,9 +17,120 @@ limitations under the License.
 package s3
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// probeTimeout limits the time of all checks of a probe
+const probeTimeout = 5 * time.Second
+
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// controller is false if the driver only serves the node service
+	controller bool
+	// topology is true if volumes are only accessible from some nodes
+	topology bool
+	// checks are run by Probe, the driver is not ready if one of them fails
+	checks []probeCheck
+}
+
+// probeCheck is a single check of Probe
+type probeCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Probe runs all checks and returns FailedPrecondition with all failed checks if the driver is not able to serve volumes
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, c := range ids.checks {
+		if err := c.check(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		klog.FromContext(ctx).Error(err, "Probe failed")
+		return nil, status.Errorf(codes.FailedPrecondition, "driver is not ready: %v", err)
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	// volumes can not be expanded, the size of a bucket is not limited
+	var capabilities []*csi.PluginCapability
+	if ids.controller {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+	if ids.topology {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+// nodeChecks make sure the node is able to mount volumes
+func nodeChecks(defaultParameters map[string]string) []probeCheck {
+	gocryptfs := defaultParameters[paramClientEncryption] == cseGocryptfs
+	return []probeCheck{
+		{name: "fuse device", check: func(context.Context) error { return checkFuseDevice() }},
+		{name: "mounter", check: func(context.Context) error { return checkMounterCommands(gocryptfs) }},
+	}
+}
+
+// endpointCheck makes sure a connection to the S3 endpoint can be established
+func endpointCheck(endpoint string) probeCheck {
+	return probeCheck{name: "endpoint", check: func(ctx context.Context) error {
+		address, err := endpointAddress(endpoint)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return fmt.Errorf("%s is not reachable: %w", redactURL(endpoint), err)
+		}
+		return conn.Close()
+	}}
+}
+
+// endpointAddress returns the host:port of an http or https URL
+func endpointAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid endpoint %q, must be an http or https URL", redactURL(endpoint))
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
 }
@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"sync"
+)
+
+const volumeOperationAlreadyExists = "an operation with the given volume %s already exists"
+
+// volumeLocks makes sure there is at most one operation per volume in progress.
+// The CO retries calls which are rejected with Aborted, as recommended by the CSI spec.
+type volumeLocks struct {
+	lock    sync.Mutex
+	volumes map[string]struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		volumes: map[string]struct{}{},
+	}
+}
+
+// tryAcquire returns false if an operation for the volume is already in progress
+func (l *volumeLocks) tryAcquire(volumeID string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.volumes[volumeID]; ok {
+		return false
+	}
+	l.volumes[volumeID] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) release(volumeID string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.volumes, volumeID)
+}
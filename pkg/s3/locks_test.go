@@ -0,0 +1,44 @@
+package s3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_volumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+	if !locks.tryAcquire("pvc-1") {
+		t.Fatal("tryAcquire() = false for a free volume")
+	}
+	if locks.tryAcquire("pvc-1") {
+		t.Error("tryAcquire() = true for a volume with an operation in progress")
+	}
+	if !locks.tryAcquire("pvc-2") {
+		t.Error("tryAcquire() = false for another volume")
+	}
+	locks.release("pvc-1")
+	if !locks.tryAcquire("pvc-1") {
+		t.Error("tryAcquire() = false after release")
+	}
+}
+
+func Test_nodeServerAborted(t *testing.T) {
+	locks := newVolumeLocks()
+	ns := &nodeServer{
+		refresher:   newCredentialsRefresher(locks),
+		volumeLocks: locks,
+	}
+	ns.volumeLocks.tryAcquire("pvc-1")
+
+	_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "pvc-1",
+		TargetPath: t.TempDir(),
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("NodeUnpublishVolume() error = %v, want Aborted", err)
+	}
+}
@@ -0,0 +1,139 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+// Formats of the logs
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Verbosity of the logs, everything else is logged with verbosity 0
+const (
+	// logLevelCalls logs every CSI call
+	logLevelCalls = 3
+	// logLevelDebug logs the commands and output of the mounters and retries of S3 calls,
+	// it is logged with verbosity 0 for volumes with the mounterDebug parameter
+	logLevelDebug = 4
+	// logLevelTrace logs the sanitized requests and responses of CSI calls
+	logLevelTrace = 5
+)
+
+// requestIDHeader is used as request id if the caller sends it
+const requestIDHeader = "x-request-id"
+
+type volumeDebugKey struct{}
+
+func parseLogFormat(format string) (string, error) {
+	switch format {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported log format %q, must be %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// setupLogging writes all logs of klog as JSON objects with the verbosity of klog if format is LogFormatJSON
+func setupLogging(format string) error {
+	format, err := parseLogFormat(format)
+	if err != nil {
+		return err
+	}
+	if format != LogFormatJSON {
+		return nil
+	}
+	verbosity := 0
+	for klog.V(klog.Level(verbosity + 1)).Enabled() {
+		verbosity++
+	}
+	klog.SetLogger(funcr.NewJSON(func(obj string) {
+		fmt.Fprintln(os.Stderr, obj)
+	}, funcr.Options{
+		LogTimestamp: true,
+		Verbosity:    verbosity,
+	}))
+	return nil
+}
+
+// loggingInterceptor passes a logger with the method, a request id, the volume of the request and the trace in the context of the call
+func loggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	logger := klog.FromContext(ctx).WithValues("method", info.FullMethod, "requestID", requestID(ctx))
+	logger = logger.WithValues(requestValues(req)...).WithValues(traceValues(ctx)...)
+	ctx = klog.NewContext(ctx, logger)
+
+	logger.V(logLevelCalls).Info("GRPC call")
+	logger.V(logLevelTrace).Info("GRPC request", "request", protosanitizer.StripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logger.Error(err, "GRPC error")
+	} else {
+		logger.V(logLevelTrace).Info("GRPC response", "response", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+// requestID returns the id sent by the caller or a new random one
+func requestID(ctx context.Context) string {
+	if md, ok := grpcmetadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDHeader); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestValues returns the volume and paths of a CSI request as key/value pairs
+func requestValues(req any) []any {
+	var values []any
+	if r, ok := req.(*csi.CreateVolumeRequest); ok {
+		values = append(values, "volumeID", r.GetName())
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		values = append(values, "volumeID", r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetStagingTargetPath() string }); ok && r.GetStagingTargetPath() != "" {
+		values = append(values, "stagingTargetPath", r.GetStagingTargetPath())
+	}
+	if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+		values = append(values, "targetPath", r.GetTargetPath())
+	}
+	return values
+}
+
+// withVolumeDebug enables the debug logs for the volume of ctx
+func withVolumeDebug(ctx context.Context, debug bool) context.Context {
+	return context.WithValue(ctx, volumeDebugKey{}, debug)
+}
+
+// volumeDebug returns true if debugging is enabled for the volume of ctx
+func volumeDebug(ctx context.Context) bool {
+	debug, _ := ctx.Value(volumeDebugKey{}).(bool)
+	return debug
+}
+
+// debugLogger returns the logger of ctx for debug logs, they are always logged if debugging is enabled for the volume
+func debugLogger(ctx context.Context) logr.Logger {
+	logger := klog.FromContext(ctx)
+	if volumeDebug(ctx) {
+		return logger
+	}
+	return logger.V(logLevelDebug)
+}
@@ -0,0 +1,67 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+func Test_loggingInterceptor(t *testing.T) {
+	var logs bytes.Buffer
+	captureLogs(t, &logs, 0)
+
+	ctx := grpcmetadata.NewIncomingContext(context.Background(), grpcmetadata.Pairs(requestIDHeader, "req-1"))
+	req := &csi.NodePublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target", StagingTargetPath: "/staging"}
+	_, err := loggingInterceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"},
+		func(ctx context.Context, req any) (any, error) {
+			klog.FromContext(ctx).Info("Inside the call")
+			return &csi.NodePublishVolumeResponse{}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	klog.Flush()
+
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "Inside the call") {
+			line = l
+		}
+	}
+	for _, want := range []string{`method="/csi.v1.Node/NodePublishVolume"`, `requestID="req-1"`, `volumeID="pvc-1"`, `targetPath="/target"`, `stagingTargetPath="/staging"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %q does not contain %s", line, want)
+		}
+	}
+
+	if id := requestID(context.Background()); len(id) != 16 {
+		t.Errorf("requestID() = %q, want a random id", id)
+	}
+}
+
+func Test_debugLogger(t *testing.T) {
+	var logs bytes.Buffer
+	captureLogs(t, &logs, 0)
+	tests := []struct {
+		debug bool
+		want  bool
+	}{
+		{debug: false, want: false},
+		{debug: true, want: true},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		ctx := withVolumeDebug(context.Background(), tt.debug)
+		debugLogger(ctx).Info("Mounter output")
+		klog.Flush()
+		if got := strings.Contains(logs.String(), "Mounter output"); got != tt.want {
+			t.Errorf("debug %v: logged %v, want %v", tt.debug, got, tt.want)
+		}
+	}
+}
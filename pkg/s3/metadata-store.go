@@ -0,0 +1,434 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// Metadata stores which can be selected with MetadataStoreOptions
+const (
+	// MetadataStoreObject stores the metadata as metadata.json in the root of the bucket
+	MetadataStoreObject = "object"
+	// MetadataStoreBucketTags stores the metadata in tags of the bucket, so the bucket only contains the files of the volume
+	MetadataStoreBucketTags = "bucket-tags"
+	// MetadataStoreKubernetes stores the metadata in a secret per volume in the namespace of the driver
+	MetadataStoreKubernetes = "kubernetes"
+)
+
+const (
+	// tagMetadataPrefix is followed by the index of the chunk, tag values are limited to 256 characters
+	tagMetadataPrefix    = "s3.csi.metal-stack.io/metadata-"
+	tagMetadataChunkSize = 256
+	maxBucketTags        = 50
+
+	metadataSecretPrefix = "csi-driver-s3-"
+	metadataSecretKey    = "metadata.json"
+	labelManagedBy       = "app.kubernetes.io/managed-by"
+	labelVolume          = "s3.csi.metal-stack.io/volume"
+)
+
+// errMetadataNotFound is returned by stores which do not return the error of the backend for missing metadata
+var errMetadataNotFound = errors.New("metadata not found")
+
+// MetadataStoreOptions select where the metadata of volumes is stored
+type MetadataStoreOptions struct {
+	// Type is one of MetadataStoreObject, MetadataStoreBucketTags or MetadataStoreKubernetes
+	Type string `json:"type,omitempty"`
+	// Namespace of the secrets of MetadataStoreKubernetes, defaults to the namespace of the driver
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// metadataStore reads and writes the metadata of volumes, the client is the one of the secret of the current call
+type metadataStore interface {
+	exists(ctx context.Context, client *s3Client, bucketName string) (bool, error)
+	get(ctx context.Context, client *s3Client, bucketName string) (*metadata, error)
+	put(ctx context.Context, client *s3Client, meta *metadata) error
+	// remove is called before the bucket is removed, the stores of the bucket leave the metadata to the removal of the bucket
+	remove(ctx context.Context, client *s3Client, bucketName string) error
+}
+
+func parseMetadataStore(storeType string) (string, error) {
+	switch storeType {
+	case "":
+		return MetadataStoreObject, nil
+	case MetadataStoreObject, MetadataStoreBucketTags, MetadataStoreKubernetes:
+		return storeType, nil
+	default:
+		return "", fmt.Errorf("unsupported metadata store %q, must be one of %s, %s or %s", storeType, MetadataStoreObject, MetadataStoreBucketTags, MetadataStoreKubernetes)
+	}
+}
+
+// newMetadataStore returns the configured store, which also reads the metadata of volumes from the other stores,
+// so existing volumes keep their metadata when the store is changed. The object store names the object metadataName,
+// the kubernetes store labels its secrets as managed by driverName.
+func newMetadataStore(opts MetadataStoreOptions, driverName, metadataName string) (metadataStore, error) {
+	storeType, err := parseMetadataStore(opts.Type)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newMetadataStoreOfType(storeType, opts.Namespace, driverName, metadataName)
+	if err != nil {
+		return nil, err
+	}
+	fallback := &fallbackMetadataStore{metadataStore: store}
+	for _, other := range []string{MetadataStoreObject, MetadataStoreBucketTags, MetadataStoreKubernetes} {
+		if other == storeType {
+			continue
+		}
+		s, err := newMetadataStoreOfType(other, opts.Namespace, driverName, metadataName)
+		if err != nil {
+			// the kubernetes store is only available in a cluster
+			klog.V(4).InfoS("Metadata store is not available as fallback", "store", other, "err", err)
+			continue
+		}
+		fallback.fallbacks = append(fallback.fallbacks, s)
+	}
+	return fallback, nil
+}
+
+func newMetadataStoreOfType(storeType, namespace, driverName, metadataName string) (metadataStore, error) {
+	switch storeType {
+	case MetadataStoreObject:
+		return &objectMetadataStore{name: metadataName}, nil
+	case MetadataStoreBucketTags:
+		return &tagMetadataStore{}, nil
+	case MetadataStoreKubernetes:
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("metadata store %s requires to run in a cluster: %w", MetadataStoreKubernetes, err)
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		if namespace == "" {
+			namespace = driverNamespace()
+		}
+		return &kubernetesMetadataStore{secrets: clientset.CoreV1().Secrets(namespace), driverName: driverName}, nil
+	default:
+		return nil, fmt.Errorf("unsupported metadata store %q", storeType)
+	}
+}
+
+// fallbackMetadataStore writes the metadata to the configured store and reads it from the fallbacks
+// if the configured store does not have it. Errors of the fallbacks are ignored, e.g. the driver might
+// not be allowed to read secrets or the backend might not support tagging.
+type fallbackMetadataStore struct {
+	metadataStore
+	fallbacks []metadataStore
+}
+
+func (s *fallbackMetadataStore) exists(ctx context.Context, client *s3Client, bucketName string) (bool, error) {
+	exists, err := s.metadataStore.exists(ctx, client, bucketName)
+	if exists || err != nil {
+		return exists, err
+	}
+	return s.fallback(ctx, client, bucketName) != nil, nil
+}
+
+func (s *fallbackMetadataStore) get(ctx context.Context, client *s3Client, bucketName string) (*metadata, error) {
+	meta, err := s.metadataStore.get(ctx, client, bucketName)
+	if errorCode(err) != codes.NotFound {
+		return meta, err
+	}
+	if fallback := s.fallback(ctx, client, bucketName); fallback != nil {
+		return fallback.get(ctx, client, bucketName)
+	}
+	return nil, err
+}
+
+func (s *fallbackMetadataStore) remove(ctx context.Context, client *s3Client, bucketName string) error {
+	if err := s.metadataStore.remove(ctx, client, bucketName); err != nil {
+		return err
+	}
+	for _, fallback := range s.fallbacks {
+		if err := fallback.remove(ctx, client, bucketName); err != nil {
+			klog.FromContext(ctx).V(4).Info("Unable to remove metadata from fallback store", "bucket", bucketName, "err", err)
+		}
+	}
+	return nil
+}
+
+// fallback returns the first fallback store which has the metadata of the bucket, nil if none has it
+func (s *fallbackMetadataStore) fallback(ctx context.Context, client *s3Client, bucketName string) metadataStore {
+	for _, fallback := range s.fallbacks {
+		exists, err := fallback.exists(ctx, client, bucketName)
+		if err != nil {
+			klog.FromContext(ctx).V(4).Info("Unable to read metadata from fallback store", "bucket", bucketName, "err", err)
+			continue
+		}
+		if exists {
+			klog.FromContext(ctx).Info("Metadata found in fallback store", "bucket", bucketName, "store", fmt.Sprintf("%T", fallback))
+			return fallback
+		}
+	}
+	return nil
+}
+
+// driverNamespace returns the namespace of the pod of the driver
+func driverNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if ns, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "kube-system"
+}
+
+// decodeMetadata parses and migrates the metadata of a bucket
+func decodeMetadata(b []byte, bucketName string) (*metadata, error) {
+	var meta metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of bucket %s: %w", bucketName, err)
+	}
+	if err := meta.migrate(); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// objectMetadataStore stores the metadata as object next to the prefix of the filesystem
+type objectMetadataStore struct {
+	// name of the object in the root of the bucket
+	name string
+}
+
+func (s *objectMetadataStore) exists(ctx context.Context, client *s3Client, bucketName string) (bool, error) {
+	var exists bool
+	err := client.do(ctx, "StatObject", "stat metadata of bucket "+bucketName, func(ctx context.Context) error {
+		_, err := client.minio.StatObject(ctx, bucketName, s.name, minio.StatObjectOptions{})
+		if code, _ := errorResponse(err); code == "NoSuchKey" {
+			exists = false
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	return exists, err
+}
+
+func (s *objectMetadataStore) get(ctx context.Context, client *s3Client, bucketName string) (*metadata, error) {
+	var b []byte
+	err := client.do(ctx, "GetObject", "get metadata of bucket "+bucketName, func(ctx context.Context) error {
+		obj, err := client.minio.GetObject(ctx, bucketName, s.name, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+		b, err = io.ReadAll(obj)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(b, bucketName)
+}
+
+func (s *objectMetadataStore) put(ctx context.Context, client *s3Client, meta *metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		ContentType: "application/json",
+	}
+	return client.do(ctx, "PutObject", "write metadata of bucket "+meta.Name, func(ctx context.Context) error {
+		_, err := client.minio.PutObject(ctx, meta.Name, s.name, bytes.NewReader(b), int64(len(b)), opts)
+		return err
+	})
+}
+
+func (s *objectMetadataStore) remove(ctx context.Context, client *s3Client, bucketName string) error {
+	// removed with the bucket
+	return nil
+}
+
+// tagMetadataStore stores the base64 encoded metadata in chunks in the tags of the bucket
+type tagMetadataStore struct{}
+
+func (s *tagMetadataStore) exists(ctx context.Context, client *s3Client, bucketName string) (bool, error) {
+	t, err := s.tags(ctx, client, bucketName)
+	if err != nil {
+		return false, err
+	}
+	_, ok := t[tagMetadataPrefix+"0"]
+	return ok, nil
+}
+
+func (s *tagMetadataStore) get(ctx context.Context, client *s3Client, bucketName string) (*metadata, error) {
+	t, err := s.tags(ctx, client, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return metadataFromTags(t, bucketName)
+}
+
+func (s *tagMetadataStore) put(ctx context.Context, client *s3Client, meta *metadata) error {
+	t, err := s.tags(ctx, client, meta.Name)
+	if err != nil {
+		return err
+	}
+	if err := setMetadataTags(t, meta); err != nil {
+		return err
+	}
+	bucketTags, err := tags.NewTags(t, false)
+	if err != nil {
+		return err
+	}
+	return client.do(ctx, "PutBucketTagging", "write metadata tags of bucket "+meta.Name, func(ctx context.Context) error {
+		return client.minio.SetBucketTagging(ctx, meta.Name, bucketTags)
+	})
+}
+
+func (s *tagMetadataStore) remove(ctx context.Context, client *s3Client, bucketName string) error {
+	// removed with the bucket
+	return nil
+}
+
+// tags returns all tags of the bucket, an empty map if it has none
+func (s *tagMetadataStore) tags(ctx context.Context, client *s3Client, bucketName string) (map[string]string, error) {
+	return client.getBucketTags(ctx, bucketName)
+}
+
+// setMetadataTags replaces the metadata in the tags, the tags of the owner are kept
+func setMetadataTags(t map[string]string, meta *metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	for k := range t {
+		if strings.HasPrefix(k, tagMetadataPrefix) {
+			delete(t, k)
+		}
+	}
+	for i, chunk := range chunks(base64.StdEncoding.EncodeToString(b), tagMetadataChunkSize) {
+		t[tagMetadataPrefix+strconv.Itoa(i)] = chunk
+	}
+	if len(t) > maxBucketTags {
+		return fmt.Errorf("metadata of bucket %s requires %d tags, only %d are allowed", meta.Name, len(t), maxBucketTags)
+	}
+	return nil
+}
+
+func metadataFromTags(t map[string]string, bucketName string) (*metadata, error) {
+	var encoded strings.Builder
+	for i := 0; ; i++ {
+		chunk, ok := t[tagMetadataPrefix+strconv.Itoa(i)]
+		if !ok {
+			break
+		}
+		encoded.WriteString(chunk)
+	}
+	if encoded.Len() == 0 {
+		return nil, fmt.Errorf("%w in tags of bucket %s", errMetadataNotFound, bucketName)
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata in tags of bucket %s: %w", bucketName, err)
+	}
+	return decodeMetadata(b, bucketName)
+}
+
+// chunks splits s into parts of at most size characters
+func chunks(s string, size int) []string {
+	var parts []string
+	for len(s) > size {
+		parts = append(parts, s[:size])
+		s = s[size:]
+	}
+	return append(parts, s)
+}
+
+// secretsClient is the part of the Kubernetes API used by kubernetesMetadataStore
+type secretsClient interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error)
+	Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error)
+	Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+// kubernetesMetadataStore stores the metadata in a secret, it might contain the scoped credentials of the volume
+type kubernetesMetadataStore struct {
+	secrets secretsClient
+	// driverName is the value of the managed-by label of the secrets
+	driverName string
+}
+
+func metadataSecretName(bucketName string) string {
+	return metadataSecretPrefix + bucketName
+}
+
+func (s *kubernetesMetadataStore) exists(ctx context.Context, client *s3Client, bucketName string) (bool, error) {
+	_, err := s.secrets.Get(ctx, metadataSecretName(bucketName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *kubernetesMetadataStore) get(ctx context.Context, client *s3Client, bucketName string) (*metadata, error) {
+	secret, err := s.secrets.Get(ctx, metadataSecretName(bucketName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w in secret %s", errMetadataNotFound, metadataSecretName(bucketName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(secret.Data[metadataSecretKey], bucketName)
+}
+
+func (s *kubernetesMetadataStore) put(ctx context.Context, client *s3Client, meta *metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: metadataSecretName(meta.Name),
+			Labels: map[string]string{
+				labelManagedBy: s.driverName,
+				labelVolume:    meta.Name,
+			},
+		},
+		Data: map[string][]byte{metadataSecretKey: b},
+	}
+	_, err = s.secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := s.secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Labels = secret.Labels
+	existing.Data = secret.Data
+	_, err = s.secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *kubernetesMetadataStore) remove(ctx context.Context, client *s3Client, bucketName string) error {
+	err := s.secrets.Delete(ctx, metadataSecretName(bucketName), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func testMetadata() *metadata {
+	meta := newMetadata("pvc-1", 1024, &bucketOptions{
+		Tags: map[string]string{tagClusterID: "cluster-a", tagPVCName: "data"},
+	}, "v1.0.0", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	meta.ScopedCredentials = &scopedCredentials{
+		Provider:        scopedCredentialsMinio,
+		AccessKeyID:     strings.Repeat("a", 20),
+		SecretAccessKey: strings.Repeat("s", 40),
+	}
+	return meta
+}
+
+func Test_metadataTags(t *testing.T) {
+	meta := testMetadata()
+	tags := map[string]string{tagPVCName: "data", tagMetadataPrefix + "7": "stale"}
+
+	if err := setMetadataTags(tags, meta); err != nil {
+		t.Fatal(err)
+	}
+	if tags[tagPVCName] != "data" {
+		t.Error("setMetadataTags() removed the tags of the owner")
+	}
+	if _, ok := tags[tagMetadataPrefix+"7"]; ok {
+		t.Error("setMetadataTags() kept a stale chunk")
+	}
+	for k, v := range tags {
+		if len(v) > tagMetadataChunkSize {
+			t.Errorf("tag %s has %d characters", k, len(v))
+		}
+	}
+
+	got, err := metadataFromTags(tags, meta.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("metadataFromTags() = %+v, want %+v", got, meta)
+	}
+
+	if _, err := metadataFromTags(map[string]string{tagPVCName: "data"}, meta.Name); !errors.Is(err, errMetadataNotFound) {
+		t.Errorf("metadataFromTags() error = %v, want %v", err, errMetadataNotFound)
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i < maxBucketTags; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	if err := setMetadataTags(tooMany, meta); err == nil {
+		t.Error("setMetadataTags() expected error for too many tags")
+	}
+}
+
+func Test_kubernetesMetadataStore(t *testing.T) {
+	ctx := context.Background()
+	store := &kubernetesMetadataStore{secrets: k8sfake.NewSimpleClientset().CoreV1().Secrets("kube-system")}
+	meta := testMetadata()
+
+	exists, err := store.exists(ctx, nil, meta.Name)
+	if err != nil || exists {
+		t.Fatalf("exists() = %v, %v before put", exists, err)
+	}
+	if _, err := store.get(ctx, nil, meta.Name); !errors.Is(err, errMetadataNotFound) {
+		t.Errorf("get() error = %v, want %v", err, errMetadataNotFound)
+	}
+
+	if err := store.put(ctx, nil, meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.CapacityBytes = 2048
+	if err := store.put(ctx, nil, meta); err != nil {
+		t.Fatalf("put() of existing metadata: %v", err)
+	}
+	exists, err = store.exists(ctx, nil, meta.Name)
+	if err != nil || !exists {
+		t.Fatalf("exists() = %v, %v after put", exists, err)
+	}
+	got, err := store.get(ctx, nil, meta.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("get() = %+v, want %+v", got, meta)
+	}
+
+	if err := store.remove(ctx, nil, meta.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.remove(ctx, nil, meta.Name); err != nil {
+		t.Errorf("remove() of missing metadata: %v", err)
+	}
+}
+
+func Test_fallbackMetadataStore(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{}
+	client := newFakeS3Client(t, fake)
+	if err := client.createBucket(ctx, "pvc-1", &bucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	kubernetesStore := &kubernetesMetadataStore{secrets: k8sfake.NewSimpleClientset().CoreV1().Secrets("kube-system")}
+	// the volume was created while the metadata was kept in secrets
+	meta := testMetadata()
+	if err := kubernetesStore.put(ctx, client, meta); err != nil {
+		t.Fatal(err)
+	}
+	store := &fallbackMetadataStore{
+		metadataStore: &tagMetadataStore{},
+		fallbacks:     []metadataStore{&objectMetadataStore{name: defaultMetadataName}, kubernetesStore},
+	}
+
+	exists, err := store.exists(ctx, client, meta.Name)
+	if err != nil || !exists {
+		t.Fatalf("exists() = %v, %v, want the metadata of the fallback", exists, err)
+	}
+	got, err := store.get(ctx, client, meta.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("get() = %+v, want %+v", got, meta)
+	}
+
+	if err := store.remove(ctx, client, meta.Name); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := kubernetesStore.exists(ctx, client, meta.Name); err != nil || exists {
+		t.Errorf("remove() kept the metadata of the fallback, exists = %v, error = %v", exists, err)
+	}
+	if _, err := store.get(ctx, client, meta.Name); !errors.Is(err, errMetadataNotFound) {
+		t.Errorf("get() error = %v, want %v", err, errMetadataNotFound)
+	}
+}
@@ -0,0 +1,153 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults of the names which can be changed in the DriverConfig
+const (
+	defaultMetadataName = "metadata.json"
+	defaultFSPrefix     = "csi-fs"
+)
+
+// metadataVersion is the version of the metadata written by this driver.
+//
+//	1: unversioned metadata with name, path, capacity, encryption, tags and scoped credentials
+//	2: adds creation time, driver version, mounter, bucket options and owner
+//	3: adds the ephemeral flag and the key secret of client-side encryption, the secret key of scoped credentials is derived
+const metadataVersion = 3
+
+// mounterS3fs is the only mounter so far, client-side encryption is layered on top of it
+const mounterS3fs = "s3fs"
+
+func parseMounter(mounter string) (string, error) {
+	switch mounter {
+	case "", mounterS3fs:
+		return mounter, nil
+	default:
+		return "", fmt.Errorf("unsupported mounter %q, must be %s", mounter, mounterS3fs)
+	}
+}
+
+// errMetadataVersion is returned for metadata written by a newer driver, it might be mounted wrongly
+var errMetadataVersion = errors.New("metadata was written by a newer driver")
+
+// metadata is stored as metadata.json in the bucket of every volume
+type metadata struct {
+	// Version is missing in metadata written before versions were introduced
+	Version       int
+	Name          string
+	FSPath        string
+	CapacityBytes int64
+	CreatedAt     time.Time
+	// DriverVersion is the version of the driver which created the volume
+	DriverVersion string
+	Mounter       string
+	Options       *volumeOptions
+	SSE           *sseConfig
+	// ClientEncryption is the scheme used to encrypt data before it is written to the bucket
+	ClientEncryption string
+	// EncryptionKeySecret holds the passphrase of the volume, it is taken from the secret of the node if nil
+	EncryptionKeySecret *secretReference
+	// Owner is the PVC the volume was created for
+	Owner *volumeOwner
+	// Tags identify the owner of the volume
+	Tags map[string]string
+	// ScopedCredentials are used by the node to mount the volume instead of the keys from the secret
+	ScopedCredentials *scopedCredentials
+	// Ephemeral volumes are removed by the controller once their PV does not exist anymore
+	Ephemeral bool
+}
+
+// volumeOptions are the bucket options of the volume which are not stored elsewhere in the metadata
+type volumeOptions struct {
+	Versioning bool
+	ObjectLock *objectLockConfig
+	Lifecycle  *lifecycleConfig
+}
+
+type volumeOwner struct {
+	ClusterID    string
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+}
+
+// metadataMigrations migrate metadata of the version of the key to the next version
+var metadataMigrations = map[int]func(meta *metadata){
+	1: migrateMetadataV1,
+	2: migrateMetadataV2,
+}
+
+// newVolumeOptions returns the options of the bucket which are recorded in the metadata
+func newVolumeOptions(opts *bucketOptions) *volumeOptions {
+	return &volumeOptions{
+		Versioning: opts.Versioning,
+		ObjectLock: opts.ObjectLock,
+		Lifecycle:  opts.Lifecycle,
+	}
+}
+
+func newMetadata(volumeID string, capacityBytes int64, opts *bucketOptions, driverVersion string, now time.Time) *metadata {
+	return &metadata{
+		Version:             metadataVersion,
+		Name:                volumeID,
+		FSPath:              opts.FSPath,
+		CapacityBytes:       capacityBytes,
+		CreatedAt:           now.UTC(),
+		DriverVersion:       driverVersion,
+		Mounter:             opts.Mounter,
+		Options:             newVolumeOptions(opts),
+		SSE:                 opts.SSE,
+		ClientEncryption:    opts.ClientEncryption,
+		EncryptionKeySecret: opts.EncryptionKeySecret,
+		Owner:               ownerFromTags(opts.Tags),
+		Tags:                opts.Tags,
+		Ephemeral:           opts.Ephemeral,
+	}
+}
+
+// migrate upgrades metadata of older versions to the current one
+func (meta *metadata) migrate() error {
+	if meta.Version == 0 {
+		meta.Version = 1
+	}
+	if meta.Version > metadataVersion {
+		return fmt.Errorf("%w: version %d of volume %s is not supported, the driver supports up to version %d", errMetadataVersion, meta.Version, meta.Name, metadataVersion)
+	}
+	for meta.Version < metadataVersion {
+		metadataMigrations[meta.Version](meta)
+		meta.Version++
+	}
+	return nil
+}
+
+func migrateMetadataV1(meta *metadata) {
+	if meta.FSPath == "" {
+		meta.FSPath = defaultFSPrefix
+	}
+	meta.Mounter = mounterS3fs
+	meta.DriverVersion = meta.Tags[tagDriverVersion]
+	meta.Owner = ownerFromTags(meta.Tags)
+	// the options were not recorded and stay nil, the bucket itself still has them
+}
+
+func migrateMetadataV2(meta *metadata) {
+	// volumes of version 2 are neither ephemeral nor have a key secret, their scoped credentials still contain the secret key
+}
+
+// ownerFromTags returns nil if the tags do not contain the owner
+func ownerFromTags(tags map[string]string) *volumeOwner {
+	owner := &volumeOwner{
+		ClusterID:    tags[tagClusterID],
+		PVCName:      tags[tagPVCName],
+		PVCNamespace: tags[tagPVCNamespace],
+		PVName:       tags[tagPVName],
+	}
+	if *owner == (volumeOwner{}) {
+		return nil
+	}
+	return owner
+}
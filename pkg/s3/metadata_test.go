@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func Test_migrate(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := newMetadata("pvc-1", 1024, &bucketOptions{
+		Versioning: true,
+		FSPath:     defaultFSPrefix,
+		Mounter:    mounterS3fs,
+		Tags:       map[string]string{tagClusterID: "cluster-a", tagPVCName: "data"},
+	}, "v1.0.0", created)
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    *metadata
+		wantErr error
+	}{
+		{
+			name: "unversioned",
+			raw:  `{"Name":"pvc-1","FSPath":"csi-fs","CapacityBytes":1024,"Tags":{"kubernetes.io/created-for/pvc/name":"data","s3.csi.metal-stack.io/driver-version":"v0.4.0"}}`,
+			want: &metadata{
+				Version:       metadataVersion,
+				Name:          "pvc-1",
+				FSPath:        defaultFSPrefix,
+				CapacityBytes: 1024,
+				DriverVersion: "v0.4.0",
+				Mounter:       mounterS3fs,
+				Owner:         &volumeOwner{PVCName: "data"},
+				Tags:          map[string]string{tagPVCName: "data", tagDriverVersion: "v0.4.0"},
+			},
+		},
+		{
+			name: "unversioned without path and tags",
+			raw:  `{"Name":"pvc-1","CapacityBytes":1024}`,
+			want: &metadata{
+				Version:       metadataVersion,
+				Name:          "pvc-1",
+				FSPath:        defaultFSPrefix,
+				CapacityBytes: 1024,
+				Mounter:       mounterS3fs,
+			},
+		},
+		{
+			name: "current",
+			raw:  mustMarshal(t, current),
+			want: current,
+		},
+		{
+			name:    "newer",
+			raw:     `{"Version":99,"Name":"pvc-1"}`,
+			wantErr: errMetadataVersion,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var meta metadata
+			if err := json.Unmarshal([]byte(tt.raw), &meta); err != nil {
+				t.Fatal(err)
+			}
+			err := meta.migrate()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("migrate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr != nil {
+				if errorCode(err) != codes.FailedPrecondition {
+					t.Errorf("errorCode() = %v, want %v", errorCode(err), codes.FailedPrecondition)
+				}
+				return
+			}
+			if !reflect.DeepEqual(&meta, tt.want) {
+				t.Errorf("migrate() = %+v, want %+v", meta, tt.want)
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,147 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "csi_s3"
+
+// Reasons of a restart of the mounter
+const (
+	restartCredentialsExpiring = "credentials-expiring"
+	restartCredentialsRotated  = "credentials-rotated"
+)
+
+// metricsRegistry holds all metrics of the driver, it is only served if a metrics address is configured
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI calls by method and gRPC code.",
+	}, []string{"method", "code"})
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Duration of CSI calls by method and gRPC code.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "code"})
+
+	s3Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_requests_total",
+		Help:      "Number of attempts of S3 and admin API calls by API.",
+	}, []string{"api"})
+	s3RequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_errors_total",
+		Help:      "Number of failed attempts of S3 and admin API calls by API and error code.",
+	}, []string{"api", "code"})
+	s3Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_duration_seconds",
+		Help:      "Duration of attempts of S3 and admin API calls by API.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"api"})
+
+	activeMounts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_mounts",
+		Help:      "Number of volumes mounted by this node by mounter.",
+	}, []string{"mounter"})
+	mounterRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mounter_restarts_total",
+		Help:      "Number of remounts of volumes by mounter and reason.",
+	}, []string{"mounter", "reason"})
+
+	reapedVolumes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reaped_volumes_total",
+		Help:      "Number of ephemeral volumes removed by the controller because their PV did not exist anymore.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		grpcRequests, grpcDuration,
+		s3Requests, s3RequestErrors, s3Duration,
+		activeMounts, mounterRestarts,
+		reapedVolumes,
+	)
+}
+
+// metricsInterceptor records the count and duration of every CSI call
+func metricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	grpcRequests.WithLabelValues(info.FullMethod, code).Inc()
+	grpcDuration.WithLabelValues(info.FullMethod, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// observeS3Request records a single attempt of an API call
+func observeS3Request(api string, start time.Time, err error) {
+	s3Requests.WithLabelValues(api).Inc()
+	s3Duration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s3RequestErrors.WithLabelValues(api, metricsErrorCode(err)).Inc()
+	}
+}
+
+// metricsErrorCode returns the error code of the backend, errors without response are reduced to a few codes
+func metricsErrorCode(err error) string {
+	if code, _ := errorResponse(err); code != "" {
+		return code
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Timeout"
+	case errors.Is(err, context.Canceled):
+		return "Canceled"
+	default:
+		return "Unknown"
+	}
+}
+
+// mounterLabel names the mounter of a volume, client-side encryption is layered on top of it
+func mounterLabel(meta *metadata) string {
+	mounter := meta.Mounter
+	if mounter == "" {
+		mounter = mounterS3fs
+	}
+	if meta.ClientEncryption != "" {
+		mounter += "+" + meta.ClientEncryption
+	}
+	return mounter
+}
+
+// serveMetrics serves the metrics on address until the driver terminates
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.InfoS("Serving metrics", "address", address)
+	if err := server.ListenAndServe(); err != nil {
+		klog.ErrorS(err, "Unable to serve metrics", "address", address)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+}
@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_metricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	before := testutil.ToFloat64(grpcRequests.WithLabelValues(info.FullMethod, codes.Aborted.String()))
+
+	_, err := metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, status.Error(codes.Aborted, "busy")
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("metricsInterceptor() changed the error to %v", err)
+	}
+	if got := testutil.ToFloat64(grpcRequests.WithLabelValues(info.FullMethod, codes.Aborted.String())); got != before+1 {
+		t.Errorf("grpc_requests_total = %v, want %v", got, before+1)
+	}
+}
+
+func Test_observeS3Request(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{err: minio.ErrorResponse{Code: "NoSuchBucket"}, code: "NoSuchBucket"},
+		{err: context.DeadlineExceeded, code: "Timeout"},
+		{err: context.Canceled, code: "Canceled"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(s3RequestErrors.WithLabelValues("HeadBucket", tt.code))
+		observeS3Request("HeadBucket", time.Now(), tt.err)
+		if got := testutil.ToFloat64(s3RequestErrors.WithLabelValues("HeadBucket", tt.code)); got != before+1 {
+			t.Errorf("s3_request_errors_total{code=%q} = %v, want %v", tt.code, got, before+1)
+		}
+	}
+}
+
+func Test_activeMounts(t *testing.T) {
+	r := newCredentialsRefresher(newVolumeLocks())
+	r.add("/a", &publishedMount{meta: &metadata{Mounter: mounterS3fs}})
+	r.add("/b", &publishedMount{meta: &metadata{Mounter: mounterS3fs, ClientEncryption: cseGocryptfs}})
+	// a remount replaces the mount of the target
+	r.add("/a", &publishedMount{meta: &metadata{Mounter: mounterS3fs}})
+
+	if got := testutil.ToFloat64(activeMounts.WithLabelValues("s3fs")); got != 1 {
+		t.Errorf("active_mounts{mounter=s3fs} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(activeMounts.WithLabelValues("s3fs+gocryptfs")); got != 1 {
+		t.Errorf("active_mounts{mounter=s3fs+gocryptfs} = %v, want 1", got)
+	}
+	r.remove("/a")
+	r.remove("/b")
+	if got := testutil.CollectAndCount(activeMounts); got != 0 {
+		t.Errorf("active_mounts has %d series after all volumes were unmounted", got)
+	}
+}
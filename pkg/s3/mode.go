@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"k8s.io/klog/v2"
+)
+
+// Modes of the driver, the controller runs once per cluster and the node on every node
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+	ModeAll        = "all"
+)
+
+// fuseDevice must be available in the container of the node
+const fuseDevice = "/dev/fuse"
+
+func parseMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ModeAll, nil
+	case ModeController, ModeNode, ModeAll:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported mode %q, must be one of %s, %s or %s", mode, ModeController, ModeNode, ModeAll)
+	}
+}
+
+func runsController(mode string) bool {
+	return mode == ModeController || mode == ModeAll
+}
+
+func runsNode(mode string) bool {
+	return mode == ModeNode || mode == ModeAll
+}
+
+// checkFusePrerequisites makes sure the node is able to mount volumes
+func checkFusePrerequisites() error {
+	if _, err := os.Stat(fuseDevice); err != nil {
+		return fmt.Errorf("%s is not available, the node container must be privileged: %w", fuseDevice, err)
+	}
+	if err := checkMounterCommands(false); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(gocryptfsCmd); errors.Is(err, exec.ErrNotFound) {
+		// only required for volumes with client-side encryption
+		klog.InfoS("Command not found, volumes with client-side encryption can not be mounted", "command", gocryptfsCmd)
+	}
+	return nil
+}
+
+// checkMounterCommands returns an error if a command required to mount volumes is missing,
+// gocryptfs is only required if the volumes are encrypted on the client by default
+func checkMounterCommands(gocryptfs bool) error {
+	cmds := []string{s3fsCmd, "umount"}
+	if gocryptfs {
+		cmds = append(cmds, gocryptfsCmd)
+	}
+	for _, cmd := range cmds {
+		if _, err := exec.LookPath(cmd); err != nil {
+			return fmt.Errorf("%s is required to mount volumes: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+// checkFuseDevice returns an error if the fuse device can not be opened, e.g. because it was removed from the container
+func checkFuseDevice() error {
+	f, err := os.OpenFile(fuseDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%s can not be opened, the node container must be privileged: %w", fuseDevice, err)
+	}
+	return f.Close()
+}
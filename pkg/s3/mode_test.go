@@ -0,0 +1,148 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_parseMode(t *testing.T) {
+	tests := []struct {
+		mode           string
+		wantController bool
+		wantNode       bool
+		wantErr        bool
+	}{
+		{mode: "", wantController: true, wantNode: true},
+		{mode: ModeAll, wantController: true, wantNode: true},
+		{mode: ModeController, wantController: true},
+		{mode: ModeNode, wantNode: true},
+		{mode: "attacher", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.mode, func(t *testing.T) {
+			mode, err := parseMode(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseMode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if runsController(mode) != tt.wantController || runsNode(mode) != tt.wantNode {
+				t.Errorf("parseMode() = %v, controller %v, node %v", mode, runsController(mode), runsNode(mode))
+			}
+		})
+	}
+}
+
+func Test_identityServerCapabilities(t *testing.T) {
+	for _, ids := range []*identityServer{
+		{controller: true},
+		{controller: false},
+		{controller: true, topology: true},
+		{controller: false, topology: true},
+	} {
+		resp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		controller, topology := false, false
+		for _, c := range resp.GetCapabilities() {
+			switch c.GetService().GetType() {
+			case csi.PluginCapability_Service_CONTROLLER_SERVICE:
+				controller = true
+			case csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS:
+				topology = true
+			}
+		}
+		if controller != ids.controller || topology != ids.topology {
+			t.Errorf("GetPluginCapabilities() advertises controller service %v and topology %v, want %v and %v", controller, topology, ids.controller, ids.topology)
+		}
+	}
+}
+
+func Test_identityServerProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		checks  []probeCheck
+		wantErr string
+	}{
+		{name: "no checks"},
+		{
+			name:   "reachable endpoint",
+			checks: []probeCheck{endpointCheck("http://" + listener.Addr().String())},
+		},
+		{
+			name:    "unreachable endpoint",
+			checks:  []probeCheck{endpointCheck("http://" + closed.Addr().String())},
+			wantErr: "endpoint: http://" + closed.Addr().String() + " is not reachable",
+		},
+		{
+			name: "all failures are reported",
+			checks: []probeCheck{
+				{name: "fuse device", check: func(context.Context) error { return errors.New("missing") }},
+				{name: "mounter", check: func(context.Context) error { return nil }},
+				{name: "endpoint", check: func(context.Context) error { return errors.New("refused") }},
+			},
+			wantErr: "fuse device: missing\nendpoint: refused",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ids := &identityServer{checks: tt.checks}
+			resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !resp.GetReady().GetValue() {
+					t.Error("Probe() is not ready")
+				}
+				return
+			}
+			if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Probe() error = %v, want FailedPrecondition with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_endpointAddress(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "https://s3.example.com", want: "s3.example.com:443"},
+		{endpoint: "http://minio:9000", want: "minio:9000"},
+		{endpoint: "http://[::1]", want: "[::1]:80"},
+		{endpoint: "s3.example.com", wantErr: true},
+		{endpoint: "ftp://s3.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := endpointAddress(tt.endpoint)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("endpointAddress(%q) = %q, %v, want %q", tt.endpoint, got, err, tt.want)
+		}
+	}
+}
@@ -1,89 +1,316 @@
 package s3
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
-// Mounter interface
+// Mounter interface, the logger of ctx is used for the logs of the mounter
 type Mounter interface {
-	Stage(stagePath string) error
-	Unstage(stagePath string) error
-	Mount(source string, target string) error
+	Stage(ctx context.Context, stagePath string) error
+	Unstage(ctx context.Context, stagePath string) error
+	Mount(ctx context.Context, source string, target string) error
+	Unmount(ctx context.Context, target string) error
 }
 
-// newMounter returns a new mounter
-func newMounter(meta *metadata, cfg *Config) Mounter {
-	return &s3fsMounter{
-		metadata:      meta,
-		url:           cfg.Endpoint,
-		region:        cfg.Region,
-		pwFileContent: cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
+// newMounter returns a new mounter, mounters holds the default options of the driver per mounter
+func newMounter(meta *metadata, cfg *Config, mounters map[string]MounterOptions, dir stateDir) Mounter {
+	var mounter Mounter = &s3fsMounter{
+		metadata:           meta,
+		stateDir:           dir,
+		url:                cfg.Endpoint,
+		region:             cfg.Region,
+		accessKeyID:        cfg.AccessKeyID,
+		secretAccessKey:    cfg.SecretAccessKey,
+		sessionToken:       cfg.SessionToken,
+		sseCustomerKey:     cfg.SSECustomerKey,
+		caBundle:           cfg.CABundle,
+		clientCert:         cfg.ClientCert,
+		clientKey:          cfg.ClientKey,
+		insecureSkipVerify: cfg.InsecureSkipVerify,
+		pathStyle:          cfg.AddressingStyle == addressingPath,
+		sigV2:              cfg.SignatureVersion == signatureV2,
+		httpProxy:          cfg.HTTPProxy,
+		options:            mounters[mounterS3fs].Options,
 	}
+	if meta.ClientEncryption == cseGocryptfs {
+		mounter = &gocryptfsMounter{
+			backend:    mounter,
+			passphrase: cfg.EncryptionPassphrase,
+			options:    mounters[cseGocryptfs].Options,
+			stateDir:   dir,
+		}
+	}
+	return mounter
 }
 
 // Implements Mounter
 type s3fsMounter struct {
-	metadata      *metadata
-	url           string
-	region        string
-	pwFileContent string
+	metadata *metadata
+	// stateDir holds the key and certificate files of the mount
+	stateDir stateDir
+	url      string
+	region   string
+	// credentials are passed in the environment, temporary credentials require a session token
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// sseCustomerKey is only required if the volume is encrypted with sse-c
+	sseCustomerKey string
+	// PEM encoded CA bundle and client certificate for the endpoint
+	caBundle           string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+	// pathStyle, sigV2 and httpProxy must match the settings of the s3Client
+	pathStyle bool
+	sigV2     bool
+	httpProxy string
+	// options are passed with -o after the options of the driver
+	options []string
 }
 
 const (
 	s3fsCmd = "s3fs"
 )
 
-func (s3fs *s3fsMounter) Stage(stageTarget string) error {
+func (s3fs *s3fsMounter) Stage(ctx context.Context, stageTarget string) error {
 	return nil
 }
 
-func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
+func (s3fs *s3fsMounter) Unstage(ctx context.Context, stageTarget string) error {
 	return nil
 }
 
-func (s3fs *s3fsMounter) Mount(source string, target string) error {
-	if err := writes3fsPass(s3fs.pwFileContent); err != nil {
+func (s3fs *s3fsMounter) Mount(ctx context.Context, source string, target string) error {
+	args, env, err := s3fs.mountArgs(target)
+	if err != nil {
 		return err
 	}
+	if volumeDebug(ctx) {
+		// s3fs logs to syslog once it runs in the background
+		args = append(args, "-o", "dbglevel=debug", "-o", "curldbg")
+	}
+	return fuseMount(ctx, s3fsCmd, args, env)
+}
+
+func (s3fs *s3fsMounter) Unmount(ctx context.Context, target string) error {
+	return fuseUnmount(target)
+}
+
+// mountArgs returns the arguments and environment of s3fs
+func (s3fs *s3fsMounter) mountArgs(target string) ([]string, []string, error) {
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.metadata.Name, s3fs.metadata.FSPath),
 		target,
-		"-o", "use_path_request_style",
 		"-o", fmt.Sprintf("url=%s", s3fs.url),
-		"-o", fmt.Sprintf("endpoint=%s", s3fs.region),
 		"-o", "allow_other",
 		"-o", "mp_umask=000",
 	}
-	return fuseMount(s3fsCmd, args)
+	if s3fs.region != "" {
+		// s3fs signs with us-east-1 otherwise and retries after the redirect of AWS
+		args = append(args, "-o", fmt.Sprintf("endpoint=%s", s3fs.region))
+	}
+	if s3fs.pathStyle {
+		args = append(args, "-o", "use_path_request_style")
+	}
+	if s3fs.sigV2 {
+		args = append(args, "-o", "sigv2")
+	}
+	if s3fs.metadata.SSE != nil {
+		opt, err := s3fs.sseOption(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "-o", opt)
+	}
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + s3fs.accessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + s3fs.secretAccessKey,
+	}
+	if s3fs.sessionToken != "" {
+		env = append(env, "AWS_SESSION_TOKEN="+s3fs.sessionToken)
+	}
+	if s3fs.httpProxy != "" {
+		// libcurl only reads the lower case variable for http
+		env = append(env, "http_proxy="+s3fs.httpProxy, "https_proxy="+s3fs.httpProxy)
+	}
+	tlsArgs, tlsEnv, err := s3fs.tlsOptions(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, tlsArgs...)
+	env = append(env, tlsEnv...)
+	for _, opt := range s3fs.options {
+		args = append(args, "-o", opt)
+	}
+	return args, env, nil
 }
 
-func writes3fsPass(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
+// tlsOptions returns the arguments and environment which configure the TLS connection of s3fs
+func (s3fs *s3fsMounter) tlsOptions(target string) ([]string, []string, error) {
+	var (
+		args []string
+		env  []string
+	)
+	if s3fs.insecureSkipVerify {
+		args = append(args, "-o", "no_check_certificate", "-o", "ssl_verify_hostname=0")
+	}
+	if s3fs.caBundle != "" {
+		// s3fs passes the bundle to libcurl
+		caFile, err := s3fs.stateDir.writeMountFile(target, "ca.crt", s3fs.caBundle)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = append(env, "CURL_CA_BUNDLE="+caFile)
+	}
+	if s3fs.clientCert != "" {
+		certFile, err := s3fs.stateDir.writeMountFile(target, "client.crt", s3fs.clientCert)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyFile, err := s3fs.stateDir.writeMountFile(target, "client.key", s3fs.clientKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "-o", fmt.Sprintf("ssl_client_cert=%s:PEM:%s:PEM", certFile, keyFile))
+	}
+	return args, env, nil
+}
+
+func (s3fs *s3fsMounter) sseOption(target string) (string, error) {
+	switch s3fs.metadata.SSE.Type {
+	case sseS3:
+		return "use_sse", nil
+	case sseKMS:
+		return fmt.Sprintf("use_sse=kmsid:%s", s3fs.metadata.SSE.KMSKeyID), nil
+	case sseC:
+		if _, err := sseCustomerKey(&Config{SSECustomerKey: s3fs.sseCustomerKey}); err != nil {
+			return "", err
+		}
+		keyFile, err := s3fs.stateDir.writeMountFile(target, "sse-c.keys", s3fs.sseCustomerKey+"\n")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("use_sse=custom:%s", keyFile), nil
+	default:
+		return "", fmt.Errorf("unsupported encryption %q", s3fs.metadata.SSE.Type)
+	}
+}
+
+// unmountVolume unmounts target and the ciphertext mount below it if the volume is encrypted on the client
+func (d stateDir) unmountVolume(target string) error {
+	if err := fuseUnmount(target); err != nil {
 		return err
 	}
-	_, err = pwFile.WriteString(pwFileContent)
+	cipherDir := d.ciphertextDir(target)
+	mounted, err := isMountPoint(cipherDir)
 	if err != nil {
 		return err
 	}
-	pwFile.Close()
+	if mounted {
+		if err := fuseUnmount(cipherDir); err != nil {
+			return err
+		}
+	}
+	return d.removeMountState(target)
+}
+
+func fuseUnmount(target string) error {
+	out, err := exec.Command("umount", "--lazy", "--force", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to umount %q output:%s err:%w", target, string(out), err)
+	}
 	return nil
 }
 
-func fuseMount(command string, args []string) error {
+// isMountPoint returns true if path is on a different device than its parent
+func isMountPoint(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		// a fuse mount whose process died can not be stat'ed anymore
+		if errors.Is(err, syscall.ENOTCONN) {
+			return true, nil
+		}
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev, nil
+}
+
+// mountAlive returns false if the process serving the fuse mount at path died
+func mountAlive(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, syscall.ENOTCONN)
+}
+
+// defaultStateDir holds the files of the mounts if the DriverConfig has no stateDir
+var defaultStateDir = filepath.Join(os.TempDir(), "csi-driver-s3")
+
+// stateDir holds the files of all mounts of the node
+type stateDir string
+
+// mountDir returns the directory which holds the files required by the mount at target
+func (d stateDir) mountDir(target string) string {
+	h := sha256.Sum256([]byte(target))
+	return filepath.Join(string(d), hex.EncodeToString(h[:8]))
+}
+
+// writeMountFile writes a file only readable by the driver which is required by the mount at target
+func (d stateDir) writeMountFile(target, name, content string) (string, error) {
+	dir := d.mountDir(target)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	fileName := filepath.Join(dir, name)
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// removeMountState removes all files written for the mount at target
+func (d stateDir) removeMountState(target string) error {
+	return os.RemoveAll(d.mountDir(target))
+}
+
+// fuseMount runs command with the environment of the driver extended by env
+func fuseMount(ctx context.Context, command string, args []string, env []string) (err error) {
+	_, span := tracer.Start(ctx, "mount "+command, trace.WithAttributes(attribute.String("mounter.command", command)))
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
 	cmd := exec.Command(command, args...)
-	klog.Infof("mounting fuse with command:%s with args:%s", command, args)
+	cmd.Env = append(os.Environ(), env...)
+	// the arguments and environment are only logged redacted, they might hold credentials
+	args, env = redactArgs(args), redactEnv(env)
+	debugLogger(ctx).Info("Mounting fuse", "command", command, "args", args, "env", env)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		klog.Errorf("mounting fuse with command:%s with args:%s error:%s", command, args, string(out))
+		klog.FromContext(ctx).Error(err, "Mounting fuse failed", "command", command, "args", args, "output", string(out))
 		return fmt.Errorf("fuseMount command:%s with args:%s error:%s", command, args, string(out))
 	}
+	debugLogger(ctx).Info("Mounted fuse", "command", command, "output", string(out))
 
 	return nil
 }
@@ -19,7 +19,6 @@ package s3
 import (
 	"fmt"
 	"os"
-	"os/exec"
 
 	"golang.org/x/net/context"
 	"k8s.io/klog/v2"
@@ -33,13 +32,25 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	refresher *credentialsRefresher
+	clients   *clientCache
+	// volumeLocks serializes the operations of a volume
+	volumeLocks *volumeLocks
+	metadata    metadataStore
+	// mounters holds the default options per mounter
+	mounters map[string]MounterOptions
+	stateDir stateDir
+	topology *nodeTopology
+	// keys reads the passphrases of volumes encrypted on the client
+	keys *encryptionKeys
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
-	klog.Infof("publish volume volumeId:%v  target:%v staging:%v", volumeID, targetPath, stagingTargetPath)
+	logger := klog.FromContext(ctx)
+	logger.Info("Publishing volume")
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
@@ -48,15 +59,22 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if len(stagingTargetPath) == 0 {
+	// inline volumes are not staged
+	ephemeral := isEphemeral(req.GetVolumeContext())
+	if len(stagingTargetPath) == 0 && !ephemeral {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target path missing in request")
 	}
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if !ns.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
+	}
+	defer ns.volumeLocks.release(volumeID)
+
 	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-		klog.Infof("target directory %s does not exist creating...", targetPath)
+		logger.V(2).Info("Creating target directory")
 		err := os.MkdirAll(targetPath, 0777)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create mkdir directory for  err:%v", err))
@@ -64,7 +82,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-		klog.Infof("staging directory %s does not exist creating...", stagingTargetPath)
+		logger.V(2).Info("Creating staging directory")
 		err = os.MkdirAll(stagingTargetPath, 0777)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create mkdir directory for  err:%v", err))
@@ -82,24 +100,97 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	attrib := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 
-	klog.Infof("target:%v device:%v readonly:%v volumeId:%v attributes:%v mountflags:%v",
-		targetPath, deviceID, readOnly, volumeID, attrib, mountFlags)
+	logger.V(2).Info("Volume", "device", deviceID, "readonly", readOnly, "attributes", attrib, "mountFlags", mountFlags)
 
-	s3, err := newS3ClientFromSecrets(req.GetSecrets())
+	debug, err := parseBool(attrib, paramMounterDebug)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx = withVolumeDebug(ctx, debug)
+
+	secrets := req.GetSecrets()
+	if ephemeral {
+		if secrets, err = ephemeralSecrets(secrets); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
-	meta, err := s3.getMetadata(volumeID)
+	s3, err := ns.clients.get(volumeSecrets(secrets, attrib))
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.InvalidArgument, "failed to initialize S3 client: %v", err)
+	}
+	var meta *metadata
+	if ephemeral {
+		meta, err = ephemeralVolume(ctx, s3, attrib)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		meta, err = ns.metadata.get(ctx, s3, volumeID)
+		if err != nil {
+			return nil, statusError(err, "failed to get metadata of volume %s", volumeID)
+		}
+	}
+	passphrase := ""
+	if meta.ClientEncryption != "" {
+		if passphrase, err = ns.keys.passphrase(ctx, meta, s3.cfg); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s: %v", volumeID, err)
+		}
 	}
 
-	mounter := newMounter(meta, s3.cfg)
-	if err := mounter.Mount(stagingTargetPath, targetPath); err != nil {
+	hash := credentialsHash(s3.cfg, meta)
+	published := &publishedMount{
+		volumeID:        volumeID,
+		source:          stagingTargetPath,
+		meta:            meta,
+		client:          s3,
+		mounters:        ns.mounters,
+		stateDir:        ns.stateDir,
+		passphrase:      passphrase,
+		debug:           debug,
+		credentialsHash: hash,
+	}
+	mounted, err := isMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		// kubelet calls NodePublishVolume periodically because of RequiresRepublish, the volume is only
+		// remounted if the credentials were rotated. The state of the mount survives restarts of the driver.
+		state, err := ns.stateDir.readMountState(targetPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if state != nil && state.CredentialsHash == hash && mountAlive(targetPath) {
+			if ns.refresher.get(targetPath) == nil {
+				published.expiration = state.Expiration
+				ns.refresher.add(targetPath, published)
+			}
+			logger.Info("Volume is already mounted")
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		logger.Info("Credentials of the volume changed or its mounter died, remounting")
+		if err := ns.stateDir.unmountVolume(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		mounterRestarts.WithLabelValues(mounterLabel(meta), restartCredentialsRotated).Inc()
+	}
+
+	cfg, expiration, err := s3.mountConfig(meta)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	cfg.EncryptionPassphrase = passphrase
+	mounter := newMounter(meta, cfg, ns.mounters, ns.stateDir)
+	if err := mounter.Mount(ctx, stagingTargetPath, targetPath); err != nil {
 		return nil, err
 	}
+	if err := ns.stateDir.writeMountState(targetPath, &mountState{CredentialsHash: hash, Expiration: expiration}); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	published.expiration = expiration
+	ns.refresher.add(targetPath, published)
 
-	klog.Infof("s3 bucket %q successfully mounted to %q", meta.Name, targetPath)
+	logger.Info("Volume mounted", "bucket", meta.Name, "mounter", mounterLabel(meta), "ephemeral", ephemeral)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -107,7 +198,8 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
-	klog.Infof("unpublish volume volumeId:%v  target:%v", volumeID, targetPath)
+	logger := klog.FromContext(ctx)
+	logger.Info("Unpublishing volume")
 
 	// Check arguments
 	if len(volumeID) == 0 {
@@ -117,12 +209,16 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	cmd := exec.Command("umount", "--lazy", "--force", targetPath)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to umount %q output:%s err:%v", targetPath, string(out), err))
+	if !ns.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
+	}
+	defer ns.volumeLocks.release(volumeID)
+
+	ns.refresher.remove(targetPath)
+	if err := ns.stateDir.unmountVolume(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	klog.Infof("s3 bucket %q has been unmounted.", volumeID)
+	logger.Info("Volume unmounted")
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -130,7 +226,7 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
-	klog.Infof("stage volume volumeId:%v stage:%v", volumeID, stagingTargetPath)
+	klog.FromContext(ctx).Info("Staging volume")
 
 	// Check arguments
 	if len(volumeID) == 0 {
@@ -145,20 +241,29 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
+	if !ns.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
+	}
+	defer ns.volumeLocks.release(volumeID)
+
 	err := os.MkdirAll(stagingTargetPath, 0777)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unable to create mkdir directory for %q err:%v", stagingTargetPath, err))
 	}
-	s3, err := newS3ClientFromSecrets(req.GetSecrets())
+	s3, err := ns.clients.get(volumeSecrets(req.GetSecrets(), req.GetVolumeContext()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize s3 client: %w", err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to initialize s3 client: %v", err)
 	}
-	meta, err := s3.getMetadata(volumeID)
+	meta, err := ns.metadata.get(ctx, s3, volumeID)
 	if err != nil {
-		return nil, err
+		return nil, statusError(err, "failed to get metadata of volume %s", volumeID)
+	}
+	cfg, _, err := s3.mountConfig(meta)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
-	mounter := newMounter(meta, s3.cfg)
-	if err := mounter.Stage(stagingTargetPath); err != nil {
+	mounter := newMounter(meta, cfg, ns.mounters, ns.stateDir)
+	if err := mounter.Stage(ctx, stagingTargetPath); err != nil {
 		return nil, err
 	}
 
@@ -168,7 +273,7 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
-	klog.Infof("unstage volume volumeId:%v stage:%v", volumeID, stagingTargetPath)
+	klog.FromContext(ctx).Info("Unstaging volume")
 
 	// Check arguments
 	if len(volumeID) == 0 {
@@ -178,9 +283,26 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if !ns.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExists, volumeID)
+	}
+	defer ns.volumeLocks.release(volumeID)
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// NodeGetInfo returns the id and the topology of the node
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	topology, err := ns.topology.get(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to get topology: %v", err)
+	}
+	return &csi.NodeGetInfoResponse{
+		NodeId:             ns.topology.nodeID,
+		AccessibleTopology: topology,
+	}, nil
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	// currently there is a single NodeServer capability according to the spec
@@ -0,0 +1,304 @@
+package s3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// StorageClass parameters understood by the driver
+const (
+	paramMounter          = "mounter"
+	paramEncryption       = "encryption"
+	paramKMSKeyID         = "kmsKeyID"
+	paramClientEncryption = "clientSideEncryption"
+	// paramEncryptionKeySecretName and paramEncryptionKeySecretNamespace reference the secret with the passphrase
+	// of a volume encrypted on the client, they may contain ${pvc.name}, ${pvc.namespace} and ${pv.name}
+	paramEncryptionKeySecretName      = "encryptionKeySecretName"
+	paramEncryptionKeySecretNamespace = "encryptionKeySecretNamespace"
+	paramScopedCredentials            = "scopedCredentials"
+	// paramEphemeral marks the scratch buckets of generic ephemeral volumes, they are removed once their PV is gone
+	paramEphemeral = "ephemeral"
+	// paramMounterDebug logs the mounter of the volume with debug output, it is only passed to the nodes
+	paramMounterDebug = "mounterDebug"
+
+	paramVersioning              = "versioning"
+	paramObjectLock              = "objectLock"
+	paramObjectLockMode          = "objectLockMode"
+	paramObjectLockRetentionDays = "objectLockRetentionDays"
+	paramExpirationDays          = "expirationDays"
+	paramTransitionDays          = "transitionDays"
+	paramTransitionStorageClass  = "transitionStorageClass"
+)
+
+// Parameters added by the external-provisioner with --extra-create-metadata
+const (
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+// Tags set on every bucket created by the driver
+const (
+	tagPVCName       = "kubernetes.io/created-for/pvc/name"
+	tagPVCNamespace  = "kubernetes.io/created-for/pvc/namespace"
+	tagPVName        = "kubernetes.io/created-for/pv/name"
+	tagClusterID     = "s3.csi.metal-stack.io/cluster-id"
+	tagDriverVersion = "s3.csi.metal-stack.io/driver-version"
+	tagEphemeral     = "s3.csi.metal-stack.io/ephemeral"
+)
+
+const (
+	objectLockGovernance = "GOVERNANCE"
+	objectLockCompliance = "COMPLIANCE"
+)
+
+// bucketOptions are the settings applied to a bucket when the volume is created
+type bucketOptions struct {
+	SSE              *sseConfig
+	ClientEncryption string
+	// EncryptionKeySecret holds the passphrase of a volume encrypted on the client, its placeholders are resolved per volume
+	EncryptionKeySecret *secretReference
+	Versioning          bool
+	ObjectLock          *objectLockConfig
+	Lifecycle           *lifecycleConfig
+	Tags                map[string]string
+	// FSPath is the prefix of the bucket which is mounted
+	FSPath string
+	// Mounter mounts the volume on the node, it falls back to the default mounter of the driver
+	Mounter string
+	// ScopedCredentials is the provider of the credentials created for the volume, empty if the keys from the secret are used
+	ScopedCredentials string
+	// Ephemeral buckets are neither versioned nor locked, so nothing is kept once they are removed
+	Ephemeral bool
+}
+
+// objectLockConfig is the default retention of objects written to a bucket with object lock enabled
+type objectLockConfig struct {
+	Mode          string
+	RetentionDays uint
+}
+
+// lifecycleConfig describes when objects of the volume are expired or transitioned to another storage class
+type lifecycleConfig struct {
+	ExpirationDays         int
+	TransitionDays         int
+	TransitionStorageClass string
+}
+
+func parseBucketOptions(params map[string]string) (*bucketOptions, error) {
+	sse, err := parseSSEConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	cse, err := parseClientEncryption(params)
+	if err != nil {
+		return nil, err
+	}
+	keySecret, err := parseEncryptionKeySecret(params, cse)
+	if err != nil {
+		return nil, err
+	}
+	versioning, err := parseBool(params, paramVersioning)
+	if err != nil {
+		return nil, err
+	}
+	objectLock, err := parseObjectLock(params)
+	if err != nil {
+		return nil, err
+	}
+	if objectLock != nil {
+		// object lock can only be enabled on versioned buckets
+		versioning = true
+	}
+	ephemeral, err := parseBool(params, paramEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	if ephemeral {
+		// retention and noncurrent versions would outlive the pod, explicit ones are rejected by checkEphemeral
+		versioning = false
+		objectLock = nil
+	}
+	lifecycle, err := parseLifecycle(params)
+	if err != nil {
+		return nil, err
+	}
+	scopedCredentials, err := parseScopedCredentials(params)
+	if err != nil {
+		return nil, err
+	}
+	mounter, err := parseMounter(params[paramMounter])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseBool(params, paramMounterDebug); err != nil {
+		return nil, err
+	}
+	return &bucketOptions{
+		SSE:                 sse,
+		ClientEncryption:    cse,
+		EncryptionKeySecret: keySecret,
+		Versioning:          versioning,
+		ObjectLock:          objectLock,
+		Lifecycle:           lifecycle,
+		Mounter:             mounter,
+		ScopedCredentials:   scopedCredentials,
+		Ephemeral:           ephemeral,
+	}, nil
+}
+
+// checkEphemeral rejects versioning and object lock which are explicitly requested for an ephemeral volume,
+// params are the parameters of the StorageClass, the ones of the defaultParameters are dropped silently
+func checkEphemeral(params map[string]string, ephemeral bool) error {
+	if !ephemeral {
+		return nil
+	}
+	for _, key := range []string{paramVersioning, paramObjectLock} {
+		enabled, err := parseBool(params, key)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return fmt.Errorf("parameter %s is not supported for ephemeral volumes", key)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns the parameters of the StorageClass completed by the default parameters of the driver
+func withDefaults(params map[string]string, defaults map[string]string) map[string]string {
+	merged := make(map[string]string, len(params)+len(defaults))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	return merged
+}
+
+// volumeContext returns the parameters with the effective bucket options, which are passed to the node
+func (o *bucketOptions) volumeContext(params map[string]string) map[string]string {
+	volumeContext := make(map[string]string, len(params))
+	for k, v := range params {
+		volumeContext[k] = v
+	}
+	// the site of the volume is only set by the controller
+	delete(volumeContext, contextSiteEndpoint)
+	delete(volumeContext, contextSiteRegion)
+	volumeContext[paramVersioning] = strconv.FormatBool(o.Versioning)
+	volumeContext[paramObjectLock] = strconv.FormatBool(o.ObjectLock != nil)
+	if o.ObjectLock != nil {
+		volumeContext[paramObjectLockMode] = o.ObjectLock.Mode
+		volumeContext[paramObjectLockRetentionDays] = strconv.FormatUint(uint64(o.ObjectLock.RetentionDays), 10)
+	}
+	return volumeContext
+}
+
+// bucketTags returns the tags which identify the owner of a bucket and whether it is ephemeral,
+// an error if a key or value is not accepted by S3
+func bucketTags(params map[string]string, clusterID string, driverVersion string, ephemeral bool) (map[string]string, error) {
+	t := map[string]string{}
+	for param, tag := range map[string]string{
+		paramPVCName:      tagPVCName,
+		paramPVCNamespace: tagPVCNamespace,
+		paramPVName:       tagPVName,
+	} {
+		if value := params[param]; value != "" {
+			t[tag] = value
+		}
+	}
+	if clusterID != "" {
+		t[tagClusterID] = clusterID
+	}
+	if driverVersion != "" {
+		t[tagDriverVersion] = driverVersion
+	}
+	if ephemeral {
+		t[tagEphemeral] = "true"
+	}
+	if _, err := tags.NewTags(t, false); err != nil {
+		return nil, fmt.Errorf("invalid bucket tags: %w", err)
+	}
+	return t, nil
+}
+
+func parseObjectLock(params map[string]string) (*objectLockConfig, error) {
+	enabled, err := parseBool(params, paramObjectLock)
+	if err != nil {
+		return nil, err
+	}
+	mode := strings.ToUpper(params[paramObjectLockMode])
+	days, err := parseDays(params, paramObjectLockRetentionDays)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		if mode != "" || days != 0 {
+			return nil, fmt.Errorf("parameters %s and %s require %s to be true", paramObjectLockMode, paramObjectLockRetentionDays, paramObjectLock)
+		}
+		return nil, nil
+	}
+	switch mode {
+	case objectLockGovernance, objectLockCompliance:
+	default:
+		return nil, fmt.Errorf("parameter %s must be %s or %s, got %q", paramObjectLockMode, objectLockGovernance, objectLockCompliance, mode)
+	}
+	if days == 0 {
+		return nil, fmt.Errorf("object lock requires parameter %s", paramObjectLockRetentionDays)
+	}
+	return &objectLockConfig{Mode: mode, RetentionDays: uint(days)}, nil
+}
+
+func parseLifecycle(params map[string]string) (*lifecycleConfig, error) {
+	expirationDays, err := parseDays(params, paramExpirationDays)
+	if err != nil {
+		return nil, err
+	}
+	transitionDays, err := parseDays(params, paramTransitionDays)
+	if err != nil {
+		return nil, err
+	}
+	storageClass := params[paramTransitionStorageClass]
+	if (transitionDays == 0) != (storageClass == "") {
+		return nil, fmt.Errorf("parameters %s and %s must be given together", paramTransitionDays, paramTransitionStorageClass)
+	}
+	if expirationDays != 0 && transitionDays != 0 && transitionDays >= expirationDays {
+		return nil, fmt.Errorf("parameter %s must be smaller than %s", paramTransitionDays, paramExpirationDays)
+	}
+	if expirationDays == 0 && transitionDays == 0 {
+		return nil, nil
+	}
+	return &lifecycleConfig{
+		ExpirationDays:         expirationDays,
+		TransitionDays:         transitionDays,
+		TransitionStorageClass: storageClass,
+	}, nil
+}
+
+func parseBool(params map[string]string, key string) (bool, error) {
+	value, ok := params[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parameter %s must be true or false, got %q", key, value)
+	}
+	return b, nil
+}
+
+func parseDays(params map[string]string, key string) (int, error) {
+	value, ok := params[key]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days <= 0 {
+		return 0, fmt.Errorf("parameter %s must be a positive number of days, got %q", key, value)
+	}
+	return days, nil
+}
@@ -0,0 +1,243 @@
+package s3
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseBucketOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *bucketOptions
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			params: map[string]string{},
+			want:   &bucketOptions{},
+		},
+		{
+			name:   "mounter",
+			params: map[string]string{"mounter": "s3fs"},
+			want:   &bucketOptions{Mounter: mounterS3fs},
+		},
+		{
+			name:    "unsupported mounter",
+			params:  map[string]string{"mounter": "goofys"},
+			wantErr: true,
+		},
+		{
+			name:   "versioning",
+			params: map[string]string{"versioning": "true"},
+			want:   &bucketOptions{Versioning: true},
+		},
+		{
+			name:    "invalid versioning",
+			params:  map[string]string{"versioning": "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:   "object lock enables versioning",
+			params: map[string]string{"objectLock": "true", "objectLockMode": "compliance", "objectLockRetentionDays": "365"},
+			want: &bucketOptions{
+				Versioning: true,
+				ObjectLock: &objectLockConfig{Mode: objectLockCompliance, RetentionDays: 365},
+			},
+		},
+		{
+			name:    "object lock without retention",
+			params:  map[string]string{"objectLock": "true", "objectLockMode": "GOVERNANCE"},
+			wantErr: true,
+		},
+		{
+			name:    "object lock with unknown mode",
+			params:  map[string]string{"objectLock": "true", "objectLockMode": "forever", "objectLockRetentionDays": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "retention without object lock",
+			params:  map[string]string{"objectLockRetentionDays": "1"},
+			wantErr: true,
+		},
+		{
+			name:   "expiration",
+			params: map[string]string{"expirationDays": "7"},
+			want:   &bucketOptions{Lifecycle: &lifecycleConfig{ExpirationDays: 7}},
+		},
+		{
+			name:   "transition and expiration",
+			params: map[string]string{"expirationDays": "365", "transitionDays": "30", "transitionStorageClass": "GLACIER"},
+			want: &bucketOptions{Lifecycle: &lifecycleConfig{
+				ExpirationDays:         365,
+				TransitionDays:         30,
+				TransitionStorageClass: "GLACIER",
+			}},
+		},
+		{
+			name:    "transition without storage class",
+			params:  map[string]string{"transitionDays": "30"},
+			wantErr: true,
+		},
+		{
+			name:    "transition after expiration",
+			params:  map[string]string{"expirationDays": "7", "transitionDays": "30", "transitionStorageClass": "GLACIER"},
+			wantErr: true,
+		},
+		{
+			name:   "scoped credentials",
+			params: map[string]string{"scopedCredentials": "MinIO"},
+			want:   &bucketOptions{ScopedCredentials: scopedCredentialsMinio},
+		},
+		{
+			name:    "unknown scoped credentials",
+			params:  map[string]string{"scopedCredentials": "ldap"},
+			wantErr: true,
+		},
+		{
+			name:   "ephemeral skips versioning and object lock of the defaults",
+			params: map[string]string{"ephemeral": "true", "versioning": "true", "objectLock": "true", "objectLockMode": "GOVERNANCE", "objectLockRetentionDays": "1"},
+			want:   &bucketOptions{Ephemeral: true},
+		},
+		{
+			name:    "invalid ephemeral",
+			params:  map[string]string{"ephemeral": "yes please"},
+			wantErr: true,
+		},
+		{
+			name:    "negative expiration",
+			params:  map[string]string{"expirationDays": "-1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBucketOptions(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseBucketOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBucketOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkEphemeral(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		ephemeral bool
+		wantErr   bool
+	}{
+		{
+			name:      "ephemeral",
+			params:    map[string]string{"ephemeral": "true"},
+			ephemeral: true,
+		},
+		{
+			name:      "without versioning",
+			params:    map[string]string{"ephemeral": "true", "versioning": "false"},
+			ephemeral: true,
+		},
+		{
+			name:      "versioning",
+			params:    map[string]string{"ephemeral": "true", "versioning": "true"},
+			ephemeral: true,
+			wantErr:   true,
+		},
+		{
+			name:      "object lock",
+			params:    map[string]string{"objectLock": "true", "objectLockMode": "GOVERNANCE", "objectLockRetentionDays": "1"},
+			ephemeral: true,
+			wantErr:   true,
+		},
+		{
+			name:   "versioning of persistent volume",
+			params: map[string]string{"versioning": "true"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkEphemeral(tt.params, tt.ephemeral); (err != nil) != tt.wantErr {
+				t.Errorf("checkEphemeral() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_bucketTags(t *testing.T) {
+	pvcParams := map[string]string{
+		paramPVCName:      "data",
+		paramPVCNamespace: "team-a",
+		paramPVName:       "pvc-1",
+		paramMounter:      "s3fs",
+	}
+	tests := []struct {
+		name          string
+		params        map[string]string
+		clusterID     string
+		driverVersion string
+		ephemeral     bool
+		want          map[string]string
+		wantErr       bool
+	}{
+		{
+			name: "without extra metadata",
+			want: map[string]string{},
+		},
+		{
+			name:          "all tags",
+			params:        pvcParams,
+			clusterID:     "cluster-a",
+			driverVersion: "v0.4.0",
+			ephemeral:     true,
+			want: map[string]string{
+				tagPVCName:       "data",
+				tagPVCNamespace:  "team-a",
+				tagPVName:        "pvc-1",
+				tagClusterID:     "cluster-a",
+				tagDriverVersion: "v0.4.0",
+				tagEphemeral:     "true",
+			},
+		},
+		{
+			name:      "persistent volume of the cluster",
+			params:    pvcParams,
+			clusterID: "cluster-a",
+			want: map[string]string{
+				tagPVCName:      "data",
+				tagPVCNamespace: "team-a",
+				tagPVName:       "pvc-1",
+				tagClusterID:    "cluster-a",
+			},
+		},
+		{
+			name:      "invalid cluster id",
+			clusterID: "cluster#a",
+			wantErr:   true,
+		},
+		{
+			name:      "too long cluster id",
+			clusterID: strings.Repeat("a", 257),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bucketTags(tt.params, tt.clusterID, tt.driverVersion, tt.ephemeral)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("bucketTags() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bucketTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// reaperGracePeriod protects new buckets, the provisioner creates their PV only after CreateVolume returned
+const reaperGracePeriod = 10 * time.Minute
+
+// ReaperOptions configure the removal of ephemeral buckets whose PV does not exist anymore
+type ReaperOptions struct {
+	// Interval between two runs of the controller, ephemeral buckets are only removed by DeleteVolume if zero
+	Interval time.Duration `json:"interval,omitempty"`
+	// SecretName is the secret with the S3 credentials the buckets are listed and removed with
+	SecretName string `json:"secretName,omitempty"`
+	// SecretNamespace defaults to the namespace of the driver
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+}
+
+// UnmarshalJSON reads the interval as duration like 1h
+func (o *ReaperOptions) UnmarshalJSON(b []byte) error {
+	type options ReaperOptions
+	aux := struct {
+		Interval string `json:"interval,omitempty"`
+		*options
+	}{options: (*options)(o)}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+	if aux.Interval != "" {
+		interval, err := time.ParseDuration(aux.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid reaper interval: %w", err)
+		}
+		o.Interval = interval
+	}
+	return nil
+}
+
+func (o ReaperOptions) validate(clusterID string) error {
+	if o.Interval < 0 {
+		return fmt.Errorf("invalid reaper interval %s, must not be negative", o.Interval)
+	}
+	if o.Interval == 0 {
+		return nil
+	}
+	var errs []error
+	if o.SecretName == "" {
+		errs = append(errs, errors.New("the reaper requires a secretName"))
+	}
+	if clusterID == "" {
+		// the tag of the cluster keeps the reaper away from the buckets of other clusters using the same account
+		errs = append(errs, errors.New("the reaper requires a clusterID"))
+	}
+	return errors.Join(errs...)
+}
+
+// persistentVolumesClient is the part of the Kubernetes API used by the reaper
+type persistentVolumesClient interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.PersistentVolume, error)
+}
+
+// reaper removes the ephemeral buckets of the cluster whose PV does not exist anymore,
+// e.g. because the PV was deleted by hand or DeleteVolume was never called for it.
+type reaper struct {
+	cs         *controllerServer
+	clusterID  string
+	interval   time.Duration
+	secretName string
+	secrets    secretsClient
+	volumes    persistentVolumesClient
+}
+
+func newReaper(opts ReaperOptions, clusterID string) (*reaper, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("the reaper requires the driver to run in kubernetes: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	namespace := opts.SecretNamespace
+	if namespace == "" {
+		namespace = driverNamespace()
+	}
+	return &reaper{
+		clusterID:  clusterID,
+		interval:   opts.Interval,
+		secretName: opts.SecretName,
+		secrets:    clientset.CoreV1().Secrets(namespace),
+		volumes:    clientset.CoreV1().PersistentVolumes(),
+	}, nil
+}
+
+func (r *reaper) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.reap(context.Background(), time.Now()); err != nil {
+			klog.ErrorS(err, "Failed to reap ephemeral volumes")
+		}
+	}
+}
+
+// reap removes the orphaned ephemeral buckets at all sites, a failed bucket does not stop the others
+func (r *reaper) reap(ctx context.Context, now time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "reap ephemeral volumes")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	secret, err := r.secrets.Get(ctx, r.secretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get secret %s: %w", r.secretName, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	var errs []error
+	for _, candidate := range r.cs.siteSecrets(secrets) {
+		client, err := r.cs.clients.get(candidate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to initialize S3 client: %w", err))
+			continue
+		}
+		errs = append(errs, r.reapSite(ctx, client, now))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *reaper) reapSite(ctx context.Context, client *s3Client, now time.Time) error {
+	buckets, err := client.listBuckets(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list buckets: %w", err)
+	}
+	var errs []error
+	for _, bucket := range buckets {
+		if now.Sub(bucket.CreationDate) < reaperGracePeriod {
+			continue
+		}
+		tags, err := client.getBucketTags(ctx, bucket.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		orphaned, err := r.orphaned(ctx, tags)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if orphaned {
+			errs = append(errs, r.remove(ctx, client, bucket.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// orphaned returns true for an ephemeral bucket of the cluster whose PV does not exist
+// the tags decide and not the metadata, the metadata of the bucket might be in another store or already removed
+func (r *reaper) orphaned(ctx context.Context, tags map[string]string) (bool, error) {
+	if tags[tagEphemeral] != "true" || tags[tagClusterID] != r.clusterID {
+		return false, nil
+	}
+	pvName := tags[tagPVName]
+	if pvName == "" {
+		// the PV is unknown if the provisioner runs without --extra-create-metadata
+		return false, nil
+	}
+	_, err := r.volumes.Get(ctx, pvName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to get PV %s: %w", pvName, err)
+	}
+	return false, nil
+}
+
+func (r *reaper) remove(ctx context.Context, client *s3Client, volumeID string) error {
+	// a volume with a running operation is removed by a later run
+	if !r.cs.volumeLocks.tryAcquire(volumeID) {
+		return nil
+	}
+	defer r.cs.volumeLocks.release(volumeID)
+
+	if err := r.cs.removeVolume(ctx, client, volumeID); err != nil {
+		return fmt.Errorf("failed to remove ephemeral volume %s: %w", volumeID, err)
+	}
+	reapedVolumes.Inc()
+	klog.FromContext(ctx).Info("Removed ephemeral volume without PV", "volumeID", volumeID)
+	return nil
+}
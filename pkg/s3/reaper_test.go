@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_reaperOrphaned(t *testing.T) {
+	r := &reaper{
+		clusterID: "cluster-a",
+		volumes: k8sfake.NewSimpleClientset(&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		}).CoreV1().PersistentVolumes(),
+	}
+	tests := []struct {
+		name string
+		tags map[string]string
+		want bool
+	}{
+		{
+			name: "PV exists",
+			tags: map[string]string{tagEphemeral: "true", tagClusterID: "cluster-a", tagPVName: "pvc-1"},
+		},
+		{
+			name: "PV missing",
+			tags: map[string]string{tagEphemeral: "true", tagClusterID: "cluster-a", tagPVName: "pvc-2"},
+			want: true,
+		},
+		{
+			name: "not ephemeral",
+			tags: map[string]string{tagClusterID: "cluster-a", tagPVName: "pvc-2"},
+		},
+		{
+			name: "other cluster",
+			tags: map[string]string{tagEphemeral: "true", tagClusterID: "cluster-b", tagPVName: "pvc-2"},
+		},
+		{
+			name: "unknown PV",
+			tags: map[string]string{tagEphemeral: "true", tagClusterID: "cluster-a"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.orphaned(context.Background(), tt.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("orphaned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reapSite(t *testing.T) {
+	type fakeVolume struct {
+		name      string
+		age       time.Duration
+		ephemeral bool
+		clusterID string
+	}
+	orphaned := func(name string) fakeVolume {
+		return fakeVolume{name: name, age: time.Hour, ephemeral: true, clusterID: "cluster-a"}
+	}
+	tests := []struct {
+		name    string
+		volumes []fakeVolume
+		// locked are the volumes with an operation in progress
+		locked []string
+		// failTags is the bucket whose tags can not be read
+		failTags string
+		removed  []string
+		wantErr  bool
+	}{
+		{
+			name:    "orphaned ephemeral volume",
+			volumes: []fakeVolume{orphaned("pvc-1")},
+			removed: []string{"pvc-1"},
+		},
+		{
+			name:    "PV exists",
+			volumes: []fakeVolume{orphaned("pvc-kept")},
+		},
+		{
+			name:    "within grace period",
+			volumes: []fakeVolume{{name: "pvc-1", age: reaperGracePeriod / 2, ephemeral: true, clusterID: "cluster-a"}},
+		},
+		{
+			name:    "grace period over",
+			volumes: []fakeVolume{{name: "pvc-1", age: reaperGracePeriod, ephemeral: true, clusterID: "cluster-a"}},
+			removed: []string{"pvc-1"},
+		},
+		{
+			name:    "not ephemeral",
+			volumes: []fakeVolume{{name: "pvc-1", age: time.Hour, clusterID: "cluster-a"}},
+		},
+		{
+			name:    "other cluster",
+			volumes: []fakeVolume{{name: "pvc-1", age: time.Hour, ephemeral: true, clusterID: "cluster-b"}},
+		},
+		{
+			name:    "operation in progress",
+			volumes: []fakeVolume{orphaned("pvc-1"), orphaned("pvc-2")},
+			locked:  []string{"pvc-1"},
+			removed: []string{"pvc-2"},
+		},
+		{
+			name:     "failing bucket does not stop the others",
+			volumes:  []fakeVolume{orphaned("pvc-1"), orphaned("pvc-2"), orphaned("pvc-kept")},
+			failTags: "pvc-1",
+			removed:  []string{"pvc-2"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			fake := &fakeS3{
+				fail: func(r *http.Request) string {
+					if tt.failTags != "" && r.Method == http.MethodGet && r.URL.Query().Has("tagging") &&
+						strings.HasPrefix(r.URL.Path, "/"+tt.failTags) {
+						return "AccessDenied"
+					}
+					return ""
+				},
+			}
+			secrets := startFakeS3(t, fake)
+			cs := newFakeControllerServer()
+			for _, v := range tt.volumes {
+				tags := map[string]string{tagClusterID: v.clusterID, tagPVName: v.name}
+				if v.ephemeral {
+					tags[tagEphemeral] = "true"
+				}
+				opts := &bucketOptions{FSPath: defaultFSPrefix, Tags: tags, Ephemeral: v.ephemeral}
+				if err := cs.ensureBucketWithMetadata(ctx, v.name, secrets, 1024, opts); err != nil {
+					t.Fatal(err)
+				}
+				fake.bucket(v.name).created = now.Add(-v.age)
+			}
+			for _, volumeID := range tt.locked {
+				cs.volumeLocks.tryAcquire(volumeID)
+			}
+			client, err := cs.clients.get(secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &reaper{
+				cs:        cs,
+				clusterID: "cluster-a",
+				volumes: k8sfake.NewSimpleClientset(&corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: "pvc-kept"},
+				}).CoreV1().PersistentVolumes(),
+			}
+
+			err = r.reapSite(ctx, client, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reapSite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			removed := map[string]bool{}
+			for _, volumeID := range tt.removed {
+				removed[volumeID] = true
+			}
+			for _, v := range tt.volumes {
+				if exists := fake.bucket(v.name) != nil; exists == removed[v.name] {
+					t.Errorf("bucket %s exists = %v, want %v", v.name, exists, !removed[v.name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"net/url"
+	"strings"
+)
+
+const redacted = "***"
+
+// sensitiveEnv are the environment variables of the mounters which hold credentials
+var sensitiveEnv = map[string]bool{
+	"AWS_ACCESS_KEY_ID":     true,
+	"AWS_SECRET_ACCESS_KEY": true,
+	"AWS_SESSION_TOKEN":     true,
+}
+
+// sensitiveOptionWords mark mounter options whose value might be a credential, e.g. passed in the mounters of the DriverConfig
+var sensitiveOptionWords = []string{"pass", "secret", "token", "key"}
+
+// proxyEnv are the environment variables which hold an URL, the password of its user is redacted
+var proxyEnv = map[string]bool{
+	"http_proxy":  true,
+	"https_proxy": true,
+}
+
+// redactEnv returns env for logging, the values of credentials are replaced
+func redactEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		switch {
+		case sensitiveEnv[name]:
+			value = redacted
+		case proxyEnv[name]:
+			value = redactURL(value)
+		}
+		out = append(out, name+"="+value)
+	}
+	return out
+}
+
+// redactArgs returns the arguments of a mounter for logging, values of options which might be credentials are replaced.
+// Options are given as -o key=value[,key=value].
+func redactArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		opts := strings.Split(arg, ",")
+		for i, opt := range opts {
+			key, value, ok := strings.Cut(opt, "=")
+			if !ok {
+				continue
+			}
+			if key == "url" {
+				opts[i] = key + "=" + redactURL(value)
+				continue
+			}
+			for _, word := range sensitiveOptionWords {
+				if strings.Contains(strings.ToLower(key), word) {
+					opts[i] = key + "=" + redacted
+					break
+				}
+			}
+		}
+		out = append(out, strings.Join(opts, ","))
+	}
+	return out
+}
+
+// redactURL replaces the password of the user of u
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		// the password can not be told apart from the rest
+		return redacted
+	}
+	if parsed.User == nil {
+		return u
+	}
+	if _, ok := parsed.User.Password(); !ok {
+		return u
+	}
+	user := url.User(parsed.User.Username()).String()
+	parsed.User = nil
+	return strings.Replace(parsed.String(), "://", "://"+user+":"+redacted+"@", 1)
+}
@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// credentialsRefreshWindow is the time before expiry at which a mount gets new credentials
+	credentialsRefreshWindow = 5 * time.Minute
+	// credentialsRefreshInterval is the time between checks for expiring credentials
+	credentialsRefreshInterval = time.Minute
+)
+
+// publishedMount is a volume mounted by this node
+type publishedMount struct {
+	volumeID string
+	source   string
+	meta     *metadata
+	client   *s3Client
+	// mounters are the default options of the driver the volume was mounted with
+	mounters map[string]MounterOptions
+	stateDir stateDir
+	// passphrase of a volume encrypted on the client, read from its key secret on publish
+	passphrase string
+	// debug is set by the mounterDebug parameter of the volume
+	debug bool
+	// credentialsHash identifies the configuration the volume was mounted with
+	credentialsHash string
+	// expiration is zero if the credentials do not expire
+	expiration time.Time
+}
+
+// credentialsRefresher keeps track of all mounts and remounts volumes with new credentials,
+// either before their temporary credentials expire or after the credentials in the secret were rotated.
+// The mounters read the credentials only on startup, so they must be restarted.
+type credentialsRefresher struct {
+	lock   sync.Mutex
+	mounts map[string]*publishedMount
+	// volumeLocks are shared with the node server, a remount must not run concurrently with a publish or unpublish
+	volumeLocks *volumeLocks
+}
+
+func newCredentialsRefresher(volumeLocks *volumeLocks) *credentialsRefresher {
+	return &credentialsRefresher{
+		mounts:      map[string]*publishedMount{},
+		volumeLocks: volumeLocks,
+	}
+}
+
+func (r *credentialsRefresher) add(target string, m *publishedMount) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mounts[target] = m
+	r.updateActiveMounts()
+}
+
+// get returns nil if nothing was mounted or registered at target since the driver started
+func (r *credentialsRefresher) get(target string) *publishedMount {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.mounts[target]
+}
+
+func (r *credentialsRefresher) remove(target string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.mounts, target)
+	r.updateActiveMounts()
+}
+
+// updateActiveMounts counts the mounts per mounter, the lock must be held
+func (r *credentialsRefresher) updateActiveMounts() {
+	activeMounts.Reset()
+	for _, m := range r.mounts {
+		activeMounts.WithLabelValues(mounterLabel(m.meta)).Inc()
+	}
+}
+
+// run checks for expiring credentials until the driver terminates
+func (r *credentialsRefresher) run() {
+	ticker := time.NewTicker(credentialsRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.refreshExpiring(time.Now())
+	}
+}
+
+func (r *credentialsRefresher) refreshExpiring(now time.Time) {
+	for target, m := range r.expiring(now) {
+		r.refresh(target, m)
+	}
+}
+
+// expiring returns the mounts whose credentials expire within the refresh window
+func (r *credentialsRefresher) expiring(now time.Time) map[string]*publishedMount {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	expiring := map[string]*publishedMount{}
+	for target, m := range r.mounts {
+		if !m.expiration.IsZero() && m.expiration.Sub(now) <= credentialsRefreshWindow {
+			expiring[target] = m
+		}
+	}
+	return expiring
+}
+
+// refresh remounts target with new credentials, a volume with an operation in progress is refreshed on the next run
+func (r *credentialsRefresher) refresh(target string, m *publishedMount) {
+	if !r.volumeLocks.tryAcquire(m.volumeID) {
+		return
+	}
+	defer r.volumeLocks.release(m.volumeID)
+	// the volume might have been unpublished or published again since the check
+	if r.get(target) != m {
+		return
+	}
+
+	logger := klog.Background().WithValues("volumeID", m.volumeID, "targetPath", target)
+	ctx := withVolumeDebug(klog.NewContext(context.Background(), logger), m.debug)
+	logger.Info("Credentials of the volume expire, remounting", "expiration", m.expiration)
+	expiration, err := m.refresh(ctx, target)
+	if err != nil {
+		logger.Error(err, "Unable to refresh credentials of the volume")
+		return
+	}
+	r.lock.Lock()
+	m.expiration = expiration
+	r.lock.Unlock()
+}
+
+// refresh fetches new credentials, remounts target with them and returns their expiration
+func (m *publishedMount) refresh(ctx context.Context, target string) (time.Time, error) {
+	// force the provider to fetch new credentials, they might not be expired yet from its point of view
+	m.client.creds.Expire()
+	cfg, expiration, err := m.client.mountConfig(m.meta)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cfg.EncryptionPassphrase = m.passphrase
+	if err := m.stateDir.unmountVolume(target); err != nil {
+		return time.Time{}, err
+	}
+	if err := newMounter(m.meta, cfg, m.mounters, m.stateDir).Mount(ctx, m.source, target); err != nil {
+		return time.Time{}, err
+	}
+	mounterRestarts.WithLabelValues(mounterLabel(m.meta), restartCredentialsExpiring).Inc()
+	if err := m.stateDir.writeMountState(target, &mountState{CredentialsHash: m.credentialsHash, Expiration: expiration}); err != nil {
+		return time.Time{}, err
+	}
+	return expiration, nil
+}
+
+// mountState is stored with the files of a mount, a restarted driver knows from it how the volume was mounted
+type mountState struct {
+	CredentialsHash string    `json:"credentialsHash"`
+	Expiration      time.Time `json:"expiration"`
+}
+
+const mountStateFile = "state.json"
+
+func (d stateDir) writeMountState(target string, state *mountState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = d.writeMountFile(target, mountStateFile, string(b))
+	return err
+}
+
+// readMountState returns nil if target was not mounted by the driver
+func (d stateDir) readMountState(target string) (*mountState, error) {
+	b, err := os.ReadFile(filepath.Join(d.mountDir(target), mountStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state mountState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("invalid state of mount %s: %w", target, err)
+	}
+	return &state, nil
+}
+
+// credentialsHash returns a fingerprint of the configuration from the secret and the scoped credentials of a volume.
+// Temporary credentials are not part of it, they are renewed without a change of the secret. The keys are left out
+// as well, the hash is stored on the host and must not allow to guess them, so only a new access key is a rotation.
+func credentialsHash(cfg *Config, meta *metadata) string {
+	identity := *cfg
+	identity.SecretAccessKey = ""
+	identity.SessionToken = ""
+	identity.SSECustomerKey = ""
+	identity.EncryptionPassphrase = ""
+	identity.ScopedCredentialsKey = ""
+	identity.ClientKey = ""
+	var scoped *scopedCredentials
+	if meta.ScopedCredentials != nil {
+		scoped = &scopedCredentials{
+			Provider:    meta.ScopedCredentials.Provider,
+			AccessKeyID: meta.ScopedCredentials.AccessKeyID,
+		}
+	}
+	return hashJSON(struct {
+		Config            *Config
+		ScopedCredentials *scopedCredentials
+	}{
+		Config:            &identity,
+		ScopedCredentials: scoped,
+	})
+}
+
+// hashJSON returns the sha256 of the JSON encoding of v
+func hashJSON(v any) string {
+	b, _ := json.Marshal(v)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
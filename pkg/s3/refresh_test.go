@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_credentialsHash(t *testing.T) {
+	cfg := &Config{AccessKeyID: "key", SecretAccessKey: "secret", Endpoint: "http://localhost:9000"}
+	meta := &metadata{Name: "pvc-1"}
+	hash := credentialsHash(cfg, meta)
+
+	tests := []struct {
+		name     string
+		cfg      *Config
+		meta     *metadata
+		wantSame bool
+	}{
+		{
+			name:     "unchanged",
+			cfg:      &Config{AccessKeyID: "key", SecretAccessKey: "secret", Endpoint: "http://localhost:9000"},
+			meta:     &metadata{Name: "pvc-1", CapacityBytes: 1024},
+			wantSame: true,
+		},
+		{
+			name: "rotated keys",
+			cfg:  &Config{AccessKeyID: "rotated", SecretAccessKey: "rotated", Endpoint: "http://localhost:9000"},
+			meta: meta,
+		},
+		{
+			// the hash is stored on the host, it must not depend on the secrets
+			name:     "secrets",
+			cfg:      &Config{AccessKeyID: "key", SecretAccessKey: "other", Endpoint: "http://localhost:9000", SSECustomerKey: "sse", EncryptionPassphrase: "passphrase", ScopedCredentialsKey: "scoped", ClientKey: "pem"},
+			meta:     &metadata{Name: "pvc-1"},
+			wantSame: true,
+		},
+		{
+			name: "endpoint",
+			cfg:  &Config{AccessKeyID: "key", SecretAccessKey: "secret", Endpoint: "http://localhost:9001"},
+			meta: meta,
+		},
+		{
+			name: "scoped credentials",
+			cfg:  cfg,
+			meta: &metadata{Name: "pvc-1", ScopedCredentials: &scopedCredentials{AccessKeyID: "scoped", SecretAccessKey: "scoped"}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := credentialsHash(tt.cfg, tt.meta) == hash; got != tt.wantSame {
+				t.Errorf("credentialsHash() same = %v, want %v", got, tt.wantSame)
+			}
+		})
+	}
+}
+
+func Test_credentialsRefresherVolumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+	r := newCredentialsRefresher(locks)
+	now := time.Now()
+	// the mount has no client, refreshing it would panic
+	m := &publishedMount{volumeID: "pvc-1", meta: &metadata{Name: "pvc-1"}, expiration: now.Add(time.Minute)}
+	r.add("/target", m)
+
+	locks.tryAcquire("pvc-1")
+	r.refreshExpiring(now)
+	if !m.expiration.Equal(now.Add(time.Minute)) {
+		t.Error("refreshExpiring() refreshed a volume with an operation in progress")
+	}
+	if !locks.tryAcquire("pvc-2") || locks.tryAcquire("pvc-1") {
+		t.Error("refreshExpiring() changed the locks of the node server")
+	}
+
+	if got := len(r.expiring(now)); got != 1 {
+		t.Errorf("expiring() = %d mounts, want 1", got)
+	}
+	if got := len(r.expiring(now.Add(-time.Hour))); got != 0 {
+		t.Errorf("expiring() an hour earlier = %d mounts, want 0", got)
+	}
+}
+
+func Test_mountState(t *testing.T) {
+	dir := stateDir(t.TempDir())
+
+	state, err := dir.readMountState("/target")
+	if err != nil || state != nil {
+		t.Fatalf("readMountState() of an unknown mount = %v, %v, want nil", state, err)
+	}
+	want := &mountState{CredentialsHash: "hash", Expiration: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := dir.writeMountState("/target", want); err != nil {
+		t.Fatal(err)
+	}
+	state, err = dir.readMountState("/target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CredentialsHash != want.CredentialsHash || !state.Expiration.Equal(want.Expiration) {
+		t.Errorf("readMountState() = %v, want %v", state, want)
+	}
+	if err := dir.removeMountState("/target"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := dir.readMountState("/target"); state != nil {
+		t.Error("readMountState() after removeMountState() is not nil")
+	}
+}
@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/minio/minio-go/v7"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultOperationTimeout is the time a single attempt of an S3 operation may take
+	defaultOperationTimeout = 30 * time.Second
+	// defaultMaxRetries is the number of retries of an S3 operation after a transient error
+	defaultMaxRetries = 3
+
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+func init() {
+	// the retries of minio-go ignore our timeouts, all retries are done by s3Client.do
+	minio.MaxRetry = 1
+}
+
+// do runs operation with a timeout for every attempt and retries it after transient errors.
+// It gives up as soon as ctx is done. Every attempt is recorded in the metrics of api, the operation is traced as a span of api.
+func (client *s3Client) do(ctx context.Context, api string, operation string, fn func(ctx context.Context) error) (err error) {
+	ctx, span := tracer.Start(ctx, api, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("s3.operation", operation), attribute.String("s3.endpoint", client.cfg.Endpoint)))
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	timeout := client.cfg.OperationTimeout
+	if timeout <= 0 {
+		timeout = defaultOperationTimeout
+	}
+	for attempt := 0; ; attempt++ {
+		span.SetAttributes(attribute.Int("s3.attempts", attempt+1))
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err = fn(attemptCtx)
+		cancel()
+		observeS3Request(api, start, err)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || attempt >= client.cfg.MaxRetries || !isTransient(err) {
+			break
+		}
+		delay := retryDelay(attempt)
+		klog.FromContext(ctx).Info("S3 call failed, retrying", "operation", operation, "api", api, "delay", delay, "err", err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error()), attribute.String("delay", delay.String())))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", operation, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return fmt.Errorf("%s: %w", operation, err)
+}
+
+// retryDelay is an exponential backoff with full jitter
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + time.Millisecond //nolint:gosec
+}
+
+// isTransient returns true for errors which might not occur again on the next attempt
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	code, statusCode := errorResponse(err)
+	switch code {
+	case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout", "OperationAborted":
+		return true
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// errorResponse returns the error code of a response of the S3 or MinIO admin API and the HTTP status of S3 responses,
+// ToErrorResponse of minio-go and madmin-go do not unwrap errors.
+func errorResponse(err error) (string, int) {
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return s3Err.Code, s3Err.StatusCode
+	}
+	var adminErr madmin.ErrorResponse
+	if errors.As(err, &adminErr) {
+		return adminErr.Code, 0
+	}
+	return "", 0
+}
+
+// errorCode maps errors of the S3 API to the gRPC code returned to the CO
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, errMetadataVersion):
+		return codes.FailedPrecondition
+	case errors.Is(err, errMetadataNotFound):
+		return codes.NotFound
+	}
+	code, _ := errorResponse(err)
+	switch code {
+	case "NoSuchBucket", "NoSuchKey", minioServiceAccountNotFound:
+		return codes.NotFound
+	case "AccessDenied", "AllAccessDisabled", "AccountProblem", "InvalidAccessKeyId", "SignatureDoesNotMatch", "InvalidToken", "ExpiredToken":
+		return codes.PermissionDenied
+	case "TooManyBuckets", "QuotaExceeded", "XMinioAdminBucketQuotaExceeded", "XMinioStorageFull":
+		return codes.ResourceExhausted
+	case "BucketAlreadyExists":
+		return codes.AlreadyExists
+	case "InvalidBucketName", "InvalidArgument":
+		return codes.InvalidArgument
+	case "NotImplemented":
+		return codes.Unimplemented
+	}
+	if isTransient(err) {
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// statusError returns err as gRPC status, errors which already are a status are passed through
+func statusError(err error, format string, args ...any) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(errorCode(err), "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+// parseRetryOptions reads the timeout and retries of S3 operations from the secret
+func parseRetryOptions(secrets map[string]string) (time.Duration, int, error) {
+	timeout := defaultOperationTimeout
+	if t := secrets["operationTimeout"]; t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid operationTimeout %q, must be a positive duration like 30s", t)
+		}
+	}
+	retries := defaultMaxRetries
+	if r := secrets["maxRetries"]; r != "" {
+		var err error
+		retries, err = strconv.Atoi(r)
+		if err != nil || retries < 0 {
+			return 0, 0, fmt.Errorf("invalid maxRetries %q, must be a non-negative number", r)
+		}
+	}
+	return timeout, retries, nil
+}
@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_errorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{
+			name: "no such bucket",
+			err:  fmt.Errorf("get metadata: %w", minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: http.StatusNotFound}),
+			want: codes.NotFound,
+		},
+		{
+			name: "access denied",
+			err:  minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden},
+			want: codes.PermissionDenied,
+		},
+		{
+			name: "slow down",
+			err:  minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable},
+			want: codes.Unavailable,
+		},
+		{
+			name: "too many buckets",
+			err:  minio.ErrorResponse{Code: "TooManyBuckets", StatusCode: http.StatusBadRequest},
+			want: codes.ResourceExhausted,
+		},
+		{
+			name: "deadline",
+			err:  fmt.Errorf("create bucket: %w", context.DeadlineExceeded),
+			want: codes.DeadlineExceeded,
+		},
+		{
+			name: "unknown",
+			err:  errors.New("boom"),
+			want: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode() = %v, want %v", got, tt.want)
+			}
+			if got := status.Code(statusError(tt.err, "operation")); got != tt.want {
+				t.Errorf("statusError() code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_do(t *testing.T) {
+	transient := minio.ErrorResponse{Code: "ServiceUnavailable", StatusCode: http.StatusServiceUnavailable}
+	permanent := minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+
+	tests := []struct {
+		name         string
+		errs         []error
+		maxRetries   int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "success after transient errors",
+			errs:         []error{transient, transient, nil},
+			maxRetries:   3,
+			wantAttempts: 3,
+		},
+		{
+			name:         "permanent errors are not retried",
+			errs:         []error{permanent, nil},
+			maxRetries:   3,
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "retries exhausted",
+			errs:         []error{transient, transient, transient},
+			maxRetries:   1,
+			wantAttempts: 2,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := &s3Client{cfg: &Config{MaxRetries: tt.maxRetries, OperationTimeout: time.Second}}
+			attempts := 0
+			err := client.do(context.Background(), "Test", "test", func(ctx context.Context) error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("do() attempts = %v, want %v", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func Test_doCanceled(t *testing.T) {
+	client := &s3Client{cfg: &Config{MaxRetries: 10, OperationTimeout: time.Second}}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := client.do(ctx, "Test", "test", func(ctx context.Context) error {
+		cancel()
+		return minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}
+	})
+	if status.Code(statusError(err, "test")) != codes.Canceled {
+		t.Errorf("do() error = %v, want canceled", err)
+	}
+}
+
+func Test_parseRetryOptions(t *testing.T) {
+	timeout, retries, err := parseRetryOptions(map[string]string{})
+	if err != nil || timeout != defaultOperationTimeout || retries != defaultMaxRetries {
+		t.Errorf("parseRetryOptions() = %v, %v, %v", timeout, retries, err)
+	}
+	timeout, retries, err = parseRetryOptions(map[string]string{"operationTimeout": "1m", "maxRetries": "0"})
+	if err != nil || timeout != time.Minute || retries != 0 {
+		t.Errorf("parseRetryOptions() = %v, %v, %v", timeout, retries, err)
+	}
+	if _, _, err := parseRetryOptions(map[string]string{"operationTimeout": "10"}); err == nil {
+		t.Error("parseRetryOptions() expected error for timeout without unit")
+	}
+	if _, _, err := parseRetryOptions(map[string]string{"maxRetries": "-1"}); err == nil {
+		t.Error("parseRetryOptions() expected error for negative retries")
+	}
+}
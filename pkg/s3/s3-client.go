@@ -3,54 +3,60 @@ package s3
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"net/url"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/minio/minio-go/v7/pkg/sse"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"k8s.io/klog/v2"
 )
 
-const (
-	metadataName = "metadata.json"
-	fsPrefix     = "csi-fs"
-)
-
 type s3Client struct {
-	cfg   *Config
-	minio *minio.Client
-}
-
-type metadata struct {
-	Name          string
-	FSPath        string
-	CapacityBytes int64
+	cfg       *Config
+	creds     *credentials.Credentials
+	transport http.RoundTripper
+	minio     *minio.Client
 }
 
-func newS3Client(cfg *Config) (*s3Client, error) {
+// newS3Client returns a client for cfg, newTransport returns the transport for the endpoint
+func newS3Client(cfg *Config, newTransport func(cfg *Config, secure bool) (*http.Transport, error)) (*s3Client, error) {
+	normalized := *cfg
 	client := &s3Client{
-		cfg: cfg,
+		cfg: &normalized,
 	}
 
-	u, err := url.Parse(client.cfg.Endpoint)
+	if err := client.cfg.normalize(); err != nil {
+		return nil, err
+	}
+	endpoint, ssl, pathPrefix, err := client.cfg.minioEndpoint()
 	if err != nil {
 		return nil, err
 	}
-	var ssl bool
-	if u.Scheme == "https" {
-		ssl = true
+	transport, err := newTransport(client.cfg, ssl)
+	if err != nil {
+		return nil, err
+	}
+	// the STS is not necessarily below the path prefix, it gets the plain transport
+	client.creds, err = newCredentials(client.cfg, transport)
+	if err != nil {
+		return nil, err
 	}
-	endpoint := u.Hostname()
-	if u.Port() != "" {
-		endpoint = u.Hostname() + ":" + u.Port()
+	client.transport = transport
+	if pathPrefix != "" {
+		client.transport = &pathPrefixTransport{prefix: pathPrefix, base: transport}
 	}
 	options := &minio.Options{
-		Creds:  credentials.NewStaticV4(client.cfg.AccessKeyID, client.cfg.SecretAccessKey, ""),
-		Region: client.cfg.Region,
-		Secure: ssl,
+		Creds:        client.creds,
+		Region:       client.cfg.Region,
+		Secure:       ssl,
+		Transport:    client.transport,
+		BucketLookup: client.cfg.bucketLookup(),
 	}
 	minioClient, err := minio.New(endpoint, options)
 	if err != nil {
@@ -60,23 +66,127 @@ func newS3Client(cfg *Config) (*s3Client, error) {
 	return client, nil
 }
 
-func newS3ClientFromSecrets(secrets map[string]string) (*s3Client, error) {
-	return newS3Client(&Config{
-		AccessKeyID:     secrets["accessKeyID"],
-		SecretAccessKey: secrets["secretAccessKey"],
-		Region:          secrets["region"],
-		Endpoint:        secrets["endpoint"],
+// configFromSecrets returns the configuration of the client from the secret of a CSI call
+func configFromSecrets(secrets map[string]string) (*Config, error) {
+	timeout, retries, err := parseRetryOptions(secrets)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		AccessKeyID:          secrets["accessKeyID"],
+		SecretAccessKey:      secrets["secretAccessKey"],
+		Region:               secrets["region"],
+		Endpoint:             secrets["endpoint"],
+		UseFIPS:              secrets["useFIPS"] == "true",
+		UseDualStack:         secrets["useDualStack"] == "true",
+		SSECustomerKey:       secrets["sseCustomerKey"],
+		EncryptionPassphrase: secrets["encryptionPassphrase"],
+		ScopedCredentialsKey: secrets["scopedCredentialsKey"],
+		CredentialsChain:     parseCredentialsChain(secrets["credentialsChain"]),
+		WebIdentityTokenFile: secrets["webIdentityTokenFile"],
+		RoleARN:              secrets["roleARN"],
+		STSEndpoint:          secrets["stsEndpoint"],
+		CABundle:             secrets["caBundle"],
+		ClientCert:           secrets["clientCert"],
+		ClientKey:            secrets["clientKey"],
+		InsecureSkipVerify:   secrets["insecureSkipVerify"] == "true",
+		AddressingStyle:      secrets["addressingStyle"],
+		SignatureVersion:     secrets["signatureVersion"],
+		HTTPProxy:            secrets["httpProxy"],
+		OperationTimeout:     timeout,
+		MaxRetries:           retries,
 		// Mounter is set in the volume preferences, not secrets
 		Mounter: "",
-	})
+	}, nil
+}
+
+// mountConfig returns the configuration for the mounter with the credentials resolved.
+// The expiration is zero if the credentials do not expire.
+func (client *s3Client) mountConfig(meta *metadata) (*Config, time.Time, error) {
+	if meta.ScopedCredentials != nil {
+		cfg, err := meta.ScopedCredentials.config(client.cfg)
+		return cfg, time.Time{}, err
+	}
+	value, err := client.creds.Get()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to get credentials: %w", err)
+	}
+	cfg := *client.cfg
+	cfg.AccessKeyID = value.AccessKeyID
+	cfg.SecretAccessKey = value.SecretAccessKey
+	cfg.SessionToken = value.SessionToken
+	return &cfg, value.Expiration, nil
 }
 
-func (client *s3Client) bucketExists(bucketName string) (bool, error) {
-	return client.minio.BucketExists(context.Background(), bucketName)
+func (client *s3Client) bucketExists(ctx context.Context, bucketName string) (bool, error) {
+	var exists bool
+	err := client.do(ctx, "HeadBucket", "check bucket "+bucketName, func(ctx context.Context) error {
+		var err error
+		exists, err = client.minio.BucketExists(ctx, bucketName)
+		return err
+	})
+	return exists, err
 }
 
-func (client *s3Client) createBucket(bucketName string) error {
-	return client.minio.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{Region: client.cfg.Region})
+// createBucket creates the bucket and applies its configuration, an existing bucket of a failed attempt is configured again
+func (client *s3Client) createBucket(ctx context.Context, bucketName string, opts *bucketOptions) error {
+	err := client.do(ctx, "CreateBucket", "create bucket "+bucketName, func(ctx context.Context) error {
+		err := client.minio.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{
+			Region:        client.cfg.Region,
+			ObjectLocking: opts.ObjectLock != nil,
+		})
+		if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+			// a previous attempt succeeded, but the response got lost
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if opts.SSE != nil {
+		if err := client.setBucketEncryption(ctx, bucketName, opts.SSE); err != nil {
+			return fmt.Errorf("unable to set encryption %s: %w", opts.SSE.Type, err)
+		}
+	}
+	if opts.Versioning {
+		err := client.do(ctx, "PutBucketVersioning", "enable versioning of bucket "+bucketName, func(ctx context.Context) error {
+			return client.minio.EnableVersioning(ctx, bucketName)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to enable versioning: %w", err)
+		}
+	}
+	if opts.ObjectLock != nil {
+		mode := minio.RetentionMode(opts.ObjectLock.Mode)
+		unit := minio.Days
+		err := client.do(ctx, "PutObjectLockConfiguration", "set object lock of bucket "+bucketName, func(ctx context.Context) error {
+			return client.minio.SetObjectLockConfig(ctx, bucketName, &mode, &opts.ObjectLock.RetentionDays, &unit)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set object lock: %w", err)
+		}
+	}
+	if opts.Lifecycle != nil {
+		if err := client.setBucketLifecycle(ctx, bucketName, opts.FSPath, opts.Lifecycle); err != nil {
+			return fmt.Errorf("unable to set lifecycle: %w", err)
+		}
+	}
+	if len(opts.Tags) > 0 {
+		err := client.setBucketTags(ctx, bucketName, opts.Tags)
+		if code, _ := errorResponse(err); code == "NotImplemented" {
+			if opts.Ephemeral {
+				return fmt.Errorf("ephemeral volumes require tagging of buckets, the reaper finds them by their tags: %w", err)
+			}
+			// tags are only informational, the owner is also recorded in the metadata
+			klog.FromContext(ctx).Info("Backend does not support tagging of buckets", "bucket", bucketName)
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set tags: %w", err)
+		}
+	}
+	return nil
 	// policy := fmt.Sprintf(`
 	// {
 	// 	"Id": "ReadBucket",
@@ -99,109 +209,186 @@ func (client *s3Client) createBucket(bucketName string) error {
 	// return client.minio.SetBucketPolicy(context.Background(), bucketName, policy)
 }
 
-func (client *s3Client) createPrefix(bucketName string, prefix string) error {
-	_, err := client.minio.PutObject(
-		context.Background(),
-		bucketName,
-		prefix+"/",
-		bytes.NewReader([]byte("")),
-		0,
-		minio.PutObjectOptions{
-			DisableMultipart: true,
-			UserMetadata:     map[string]string{"createdby": "csi-driver-s3"},
-		})
+func (client *s3Client) setBucketTags(ctx context.Context, bucketName string, tagMap map[string]string) error {
+	t, err := tags.NewTags(tagMap, false)
 	if err != nil {
 		return err
 	}
-	return nil
+	return client.do(ctx, "PutBucketTagging", "set tags of bucket "+bucketName, func(ctx context.Context) error {
+		return client.minio.SetBucketTagging(ctx, bucketName, t)
+	})
 }
 
-func (client *s3Client) removeBucket(bucketName string) error {
-	if err := client.emptyBucket(bucketName); err != nil {
-		return err
+// setBucketLifecycle applies the rules only to the filesystem prefix, the metadata must never expire
+func (client *s3Client) setBucketLifecycle(ctx context.Context, bucketName string, prefix string, lc *lifecycleConfig) error {
+	rule := lifecycle.Rule{
+		ID:     "csi-driver-s3",
+		Status: "Enabled",
+		RuleFilter: lifecycle.Filter{
+			Prefix: prefix + "/",
+		},
 	}
-	return client.minio.RemoveBucket(context.Background(), bucketName)
-}
-
-func (client *s3Client) emptyBucket(bucketName string) error {
-	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
-
-	go func() {
-		defer close(objectsCh)
-
-		for object := range client.minio.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
-			}
-			objectsCh <- object
+	if lc.ExpirationDays > 0 {
+		rule.Expiration = lifecycle.Expiration{Days: lifecycle.ExpirationDays(lc.ExpirationDays)}
+	}
+	if lc.TransitionDays > 0 {
+		rule.Transition = lifecycle.Transition{
+			Days:         lifecycle.ExpirationDays(lc.TransitionDays),
+			StorageClass: lc.TransitionStorageClass,
 		}
-	}()
+	}
+	config := lifecycle.NewConfiguration()
+	config.Rules = []lifecycle.Rule{rule}
+	return client.do(ctx, "PutBucketLifecycleConfiguration", "set lifecycle of bucket "+bucketName, func(ctx context.Context) error {
+		return client.minio.SetBucketLifecycle(ctx, bucketName, config)
+	})
+}
 
-	if listErr != nil {
-		klog.Errorf("Error listing objects:%v", listErr)
-		return listErr
+func (client *s3Client) setBucketEncryption(ctx context.Context, bucketName string, enc *sseConfig) error {
+	var config *sse.Configuration
+	switch enc.Type {
+	case sseS3:
+		config = sse.NewConfigurationSSES3()
+	case sseKMS:
+		config = sse.NewConfigurationSSEKMS(enc.KMSKeyID)
+	default:
+		// sse-c can not be set as bucket default, the key is sent with every request
+		return nil
 	}
+	return client.do(ctx, "PutBucketEncryption", "set encryption of bucket "+bucketName, func(ctx context.Context) error {
+		return client.minio.SetBucketEncryption(ctx, bucketName, config)
+	})
+}
 
-	errorCh := client.minio.RemoveObjects(context.Background(), bucketName, objectsCh, minio.RemoveObjectsOptions{})
-	for e := range errorCh {
-		klog.Errorf("Failed to remove object %q, error:%v", e.ObjectName, e.Err)
+// validateBucketEncryption checks that the backend applies the requested encryption as bucket default
+func (client *s3Client) validateBucketEncryption(ctx context.Context, bucketName string, enc *sseConfig) error {
+	if enc == nil || enc.Type == sseC {
+		return nil
+	}
+	var config *sse.Configuration
+	err := client.do(ctx, "GetBucketEncryption", "get encryption of bucket "+bucketName, func(ctx context.Context) error {
+		var err error
+		config, err = client.minio.GetBucketEncryption(ctx, bucketName)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	if len(errorCh) != 0 {
-		return fmt.Errorf("Failed to remove all objects of bucket %s", bucketName)
+	for _, rule := range config.Rules {
+		apply := rule.Apply
+		switch enc.Type {
+		case sseS3:
+			if apply.SSEAlgorithm == "AES256" {
+				return nil
+			}
+		case sseKMS:
+			if apply.SSEAlgorithm == "aws:kms" && strings.HasSuffix(apply.KmsMasterKeyID, enc.KMSKeyID) {
+				return nil
+			}
+		}
 	}
+	return fmt.Errorf("bucket %s is not encrypted with %s", bucketName, enc.Type)
+}
 
-	// ensure our prefix is also removed
-	return client.minio.RemoveObject(context.Background(), bucketName, fsPrefix, minio.RemoveObjectOptions{})
+func (client *s3Client) createPrefix(ctx context.Context, bucketName string, prefix string, serverSide encrypt.ServerSide) error {
+	return client.do(ctx, "PutObject", "create prefix "+prefix+" in bucket "+bucketName, func(ctx context.Context) error {
+		_, err := client.minio.PutObject(
+			ctx,
+			bucketName,
+			prefix+"/",
+			bytes.NewReader([]byte("")),
+			0,
+			minio.PutObjectOptions{
+				DisableMultipart:     true,
+				UserMetadata:         map[string]string{"createdby": "csi-driver-s3"},
+				ServerSideEncryption: serverSide,
+			})
+		return err
+	})
 }
 
-func (client *s3Client) metadataExist(bucketName string) bool {
-	listOpts := minio.ListObjectsOptions{
-		Recursive: false,
-		Prefix:    metadataName,
-	}
-	for objs := range client.minio.ListObjects(context.Background(), bucketName, listOpts) {
-		if objs.Err != nil {
-			return false
+// getBucketTags returns all tags of the bucket, an empty map if it has none
+func (client *s3Client) getBucketTags(ctx context.Context, bucketName string) (map[string]string, error) {
+	t := map[string]string{}
+	err := client.do(ctx, "GetBucketTagging", "get tags of bucket "+bucketName, func(ctx context.Context) error {
+		bucketTags, err := client.minio.GetBucketTagging(ctx, bucketName)
+		if code, _ := errorResponse(err); code == "NoSuchTagSet" {
+			return nil
 		}
-		if objs.ContentType == "application/json" {
-			return true
+		if err != nil {
+			return err
 		}
-	}
-	return false
+		t = bucketTags.ToMap()
+		return nil
+	})
+	return t, err
 }
 
-func (client *s3Client) writeMetadata(bucket *metadata) error {
-	b := new(bytes.Buffer)
-	err := json.NewEncoder(b).Encode(bucket)
-	if err != nil {
+func (client *s3Client) listBuckets(ctx context.Context) ([]minio.BucketInfo, error) {
+	var buckets []minio.BucketInfo
+	err := client.do(ctx, "ListBuckets", "list buckets", func(ctx context.Context) error {
+		var err error
+		buckets, err = client.minio.ListBuckets(ctx)
 		return err
-	}
-	opts := minio.PutObjectOptions{
-		ContentType: "application/json",
-	}
-	_, err = client.minio.PutObject(context.Background(), bucket.Name, metadataName, b, int64(b.Len()), opts)
-	return err
+	})
+	return buckets, err
 }
 
-func (client *s3Client) getMetadata(bucketName string) (*metadata, error) {
-	opts := minio.GetObjectOptions{}
-	obj, err := client.minio.GetObject(context.Background(), bucketName, metadataName, opts)
-	if err != nil {
-		return nil, err
-	}
-	objInfo, err := obj.Stat()
-	if err != nil {
-		return nil, err
+func (client *s3Client) removeBucket(ctx context.Context, bucketName string) error {
+	if err := client.emptyBucket(ctx, bucketName); err != nil {
+		return err
 	}
-	b := make([]byte, objInfo.Size)
-	_, err = obj.Read(b)
+	return client.do(ctx, "DeleteBucket", "remove bucket "+bucketName, func(ctx context.Context) error {
+		return client.minio.RemoveBucket(ctx, bucketName)
+	})
+}
 
-	if err != nil && !errors.Is(err, io.EOF) {
-		return nil, err
-	}
-	var meta metadata
-	err = json.Unmarshal(b, &meta)
-	return &meta, err
+// emptyBucket removes all versions of all objects, the whole listing is one attempt which is repeated after transient errors
+func (client *s3Client) emptyBucket(ctx context.Context, bucketName string) error {
+	return client.do(ctx, "DeleteObjects", "empty bucket "+bucketName, func(ctx context.Context) error {
+		// RemoveObjects might return before it drained the channel, cancelling stops the listing then
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		objectsCh := make(chan minio.ObjectInfo)
+		listDone := make(chan struct{})
+		var listErr error
+
+		go func() {
+			defer close(listDone)
+			defer close(objectsCh)
+
+			// all versions must be removed, otherwise a versioned bucket can not be deleted
+			for object := range client.minio.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Recursive: true, WithVersions: true}) {
+				if object.Err != nil {
+					listErr = object.Err
+					return
+				}
+				select {
+				case objectsCh <- object:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		var removeErr error
+		// the listing contains the versions and delete markers of all prefixes, removing them by version id
+		// never creates new delete markers. Objects retained in governance mode are removed as well.
+		for e := range client.minio.RemoveObjects(ctx, bucketName, objectsCh, minio.RemoveObjectsOptions{GovernanceBypass: true}) {
+			klog.FromContext(ctx).Error(e.Err, "Failed to remove object", "bucket", bucketName, "object", e.ObjectName)
+			removeErr = e.Err
+		}
+		cancel()
+		<-listDone
+		if removeErr != nil {
+			// the listing might have been cancelled after the removal failed
+			return removeErr
+		}
+		if listErr != nil {
+			klog.FromContext(ctx).Error(listErr, "Failed to list objects", "bucket", bucketName)
+			return listErr
+		}
+		return nil
+	})
 }
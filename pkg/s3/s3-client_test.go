@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func Test_removeBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *bucketOptions
+	}{
+		{
+			name: "unversioned",
+			opts: &bucketOptions{FSPath: defaultFSPrefix},
+		},
+		{
+			name: "versioned",
+			opts: &bucketOptions{FSPath: defaultFSPrefix, Versioning: true},
+		},
+		{
+			name: "object lock with custom prefix",
+			opts: &bucketOptions{FSPath: "data", Versioning: true, ObjectLock: &objectLockConfig{Mode: "GOVERNANCE", RetentionDays: 1}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			fake := &fakeS3{}
+			client := newFakeS3Client(t, fake)
+			if err := client.createBucket(ctx, "pvc-1", tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.createPrefix(ctx, "pvc-1", tt.opts.FSPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			// overwritten and deleted objects leave versions and delete markers behind
+			for _, key := range []string{tt.opts.FSPath + "/file", tt.opts.FSPath + "/file", defaultMetadataName} {
+				if err := client.createPrefix(ctx, "pvc-1", key, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fake.lock.Lock()
+			fake.deleteObject(fake.buckets["pvc-1"], tt.opts.FSPath+"/file/", "")
+			fake.lock.Unlock()
+
+			if err := client.removeBucket(ctx, "pvc-1"); err != nil {
+				t.Fatalf("removeBucket() error = %v", err)
+			}
+			if fake.bucket("pvc-1") != nil {
+				t.Error("bucket still exists")
+			}
+		})
+	}
+}
+
+func Test_createBucketWithoutTagging(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *bucketOptions
+		wantErr bool
+	}{
+		{
+			name: "persistent",
+			opts: &bucketOptions{FSPath: defaultFSPrefix, Tags: map[string]string{tagClusterID: "cluster-a"}},
+		},
+		{
+			name:    "ephemeral",
+			opts:    &bucketOptions{FSPath: defaultFSPrefix, Ephemeral: true, Tags: map[string]string{tagEphemeral: "true"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeS3{
+				fail: func(r *http.Request) string {
+					if r.Method == http.MethodPut && r.URL.Query().Has("tagging") {
+						return "NotImplemented"
+					}
+					return ""
+				},
+			}
+			client := newFakeS3Client(t, fake)
+			if err := client.createBucket(context.Background(), "pvc-1", tt.opts); (err != nil) != tt.wantErr {
+				t.Errorf("createBucket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
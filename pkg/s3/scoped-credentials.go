@@ -0,0 +1,215 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/madmin-go/v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// scopedCredentialsMinio creates a service account with a bucket scoped policy with the MinIO admin API
+	scopedCredentialsMinio = "minio"
+
+	minioServiceAccountNotFound = "XMinioAdminServiceAccountNotFound"
+	// minioServiceAccountNameLength is the maximum length of the name of a service account
+	minioServiceAccountNameLength = 32
+)
+
+// scopedCredentials only grant access to the bucket of a single volume. The secret key is derived from
+// the access key and the scopedCredentialsKey of the secret, so it is never stored in the metadata.
+type scopedCredentials struct {
+	Provider    string
+	AccessKeyID string
+	// SecretAccessKey is only set in the metadata of volumes created before the secret keys were derived
+	SecretAccessKey string `json:",omitempty"`
+}
+
+// credentialsProvisioner creates and revokes scoped credentials on the backend
+type credentialsProvisioner interface {
+	create(ctx context.Context, bucketName string) (*scopedCredentials, error)
+	revoke(ctx context.Context, creds *scopedCredentials) error
+}
+
+func parseScopedCredentials(params map[string]string) (string, error) {
+	provider := strings.ToLower(params[paramScopedCredentials])
+	switch provider {
+	case "", scopedCredentialsMinio:
+		return provider, nil
+	default:
+		return "", fmt.Errorf("unsupported scoped credentials %q, must be %s", provider, scopedCredentialsMinio)
+	}
+}
+
+// newCredentialsProvisioner returns the provisioner of provider, the credentials are described with driverName
+// and must not be able to modify the object metadataName
+func newCredentialsProvisioner(provider string, client *s3Client, driverName, metadataName string) (credentialsProvisioner, error) {
+	switch provider {
+	case scopedCredentialsMinio:
+		u := client.minio.EndpointURL()
+		admin, err := madmin.NewWithOptions(u.Host, &madmin.Options{
+			Creds:     client.creds,
+			Secure:    u.Scheme == "https",
+			Transport: client.transport,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize minio admin client: %w", err)
+		}
+		return &minioCredentialsProvisioner{client: client, admin: admin, driverName: driverName, metadataName: metadataName}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scoped credentials %q", provider)
+	}
+}
+
+// config returns a copy of cfg which uses the scoped credentials
+func (s *scopedCredentials) config(cfg *Config) (*Config, error) {
+	scoped := *cfg
+	scoped.AccessKeyID = s.AccessKeyID
+	scoped.SecretAccessKey = s.SecretAccessKey
+	if scoped.SecretAccessKey == "" {
+		secretKey, err := scopedSecretKey(cfg, s.AccessKeyID)
+		if err != nil {
+			return nil, err
+		}
+		scoped.SecretAccessKey = secretKey
+	}
+	return &scoped, nil
+}
+
+// scopedAccessKey returns the access key of the scoped credentials of a volume, it is the same for every attempt
+func scopedAccessKey(volumeID string) string {
+	h := sha256.Sum256([]byte(volumeID))
+	// access keys of MinIO are at most 20 characters long
+	return "csi" + hex.EncodeToString(h[:])[:17]
+}
+
+// scopedSecretKey derives the secret key of scoped credentials from the scopedCredentialsKey of the secret
+func scopedSecretKey(cfg *Config, accessKey string) (string, error) {
+	if cfg.ScopedCredentialsKey == "" {
+		return "", errors.New("scoped credentials require scopedCredentialsKey in secret")
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.ScopedCredentialsKey))
+	mac.Write([]byte(accessKey))
+	// secret keys of MinIO are at most 40 characters long
+	return hex.EncodeToString(mac.Sum(nil))[:40], nil
+}
+
+type minioCredentialsProvisioner struct {
+	// client applies the timeouts and retries of S3 operations to the admin API
+	client       *s3Client
+	admin        *madmin.AdminClient
+	driverName   string
+	metadataName string
+}
+
+// create adds the service account of the bucket, an account left over from a failed attempt is reused
+func (m *minioCredentialsProvisioner) create(ctx context.Context, bucketName string) (*scopedCredentials, error) {
+	accessKey := scopedAccessKey(bucketName)
+	secretKey, err := scopedSecretKey(m.client.cfg, accessKey)
+	if err != nil {
+		return nil, err
+	}
+	creds := &scopedCredentials{
+		Provider:    scopedCredentialsMinio,
+		AccessKeyID: accessKey,
+	}
+	err = m.client.do(ctx, "InfoServiceAccount", "get service account "+accessKey, func(ctx context.Context) error {
+		_, err := m.admin.InfoServiceAccount(ctx, accessKey)
+		return err
+	})
+	if err == nil {
+		klog.FromContext(ctx).Info("Service account already exists", "accessKeyID", accessKey)
+		return creds, nil
+	}
+	if code, _ := errorResponse(err); code != minioServiceAccountNotFound {
+		return nil, fmt.Errorf("unable to get service account for bucket %s: %w", bucketName, err)
+	}
+
+	policy, err := bucketPolicy(bucketName, m.metadataName)
+	if err != nil {
+		return nil, err
+	}
+	err = m.client.do(ctx, "AddServiceAccount", "add service account for bucket "+bucketName, func(ctx context.Context) error {
+		_, err := m.admin.AddServiceAccount(ctx, madmin.AddServiceAccountReq{
+			Policy:      policy,
+			AccessKey:   accessKey,
+			SecretKey:   secretKey,
+			Name:        serviceAccountName(bucketName),
+			Description: fmt.Sprintf("created by %s for volume %s", m.driverName, bucketName),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create service account for bucket %s: %w", bucketName, err)
+	}
+	return creds, nil
+}
+
+// serviceAccountName returns a name of the service account of a bucket which is accepted by MinIO
+func serviceAccountName(bucketName string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, bucketName)
+	if name == "" || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		name = "csi-" + name
+	}
+	if len(name) > minioServiceAccountNameLength {
+		name = name[:minioServiceAccountNameLength]
+	}
+	return name
+}
+
+func (m *minioCredentialsProvisioner) revoke(ctx context.Context, creds *scopedCredentials) error {
+	err := m.client.do(ctx, "DeleteServiceAccount", "delete service account "+creds.AccessKeyID, func(ctx context.Context) error {
+		return m.admin.DeleteServiceAccount(ctx, creds.AccessKeyID)
+	})
+	if code, _ := errorResponse(err); code == minioServiceAccountNotFound {
+		klog.FromContext(ctx).Info("Service account already removed", "accessKeyID", creds.AccessKeyID)
+		return nil
+	}
+	return err
+}
+
+// bucketPolicy grants only the calls s3fs and gocryptfs on top of it make to the objects of the bucket,
+// the configuration of the bucket and the volume metadata can not be changed with the scoped credentials
+func bucketPolicy(bucketName, metadataName string) ([]byte, error) {
+	type statement struct {
+		Effect   string
+		Action   []string
+		Resource []string
+	}
+	return json.Marshal(struct {
+		Version   string
+		Statement []statement
+	}{
+		Version: "2012-10-17",
+		Statement: []statement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation", "s3:ListBucket", "s3:ListBucketMultipartUploads"},
+				Resource: []string{"arn:aws:s3:::" + bucketName},
+			},
+			{
+				// s3:PutObject also covers copying objects and creating, uploading and completing multipart uploads
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+				Resource: []string{"arn:aws:s3:::" + bucketName + "/*"},
+			},
+			{
+				Effect:   "Deny",
+				Action:   []string{"s3:PutObject", "s3:DeleteObject"},
+				Resource: []string{"arn:aws:s3:::" + bucketName + "/" + metadataName},
+			},
+		},
+	})
+}
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_bucketPolicy(t *testing.T) {
+	b, err := bucketPolicy("pvc-1", defaultMetadataName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type statement struct {
+		Effect   string
+		Action   []string
+		Resource []string
+	}
+	var policy struct {
+		Version   string
+		Statement []statement
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		t.Fatal(err)
+	}
+	want := []statement{
+		{Effect: "Allow", Action: []string{"s3:GetBucketLocation", "s3:ListBucket", "s3:ListBucketMultipartUploads"}, Resource: []string{"arn:aws:s3:::pvc-1"}},
+		{Effect: "Allow", Action: []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"}, Resource: []string{"arn:aws:s3:::pvc-1/*"}},
+		{Effect: "Deny", Action: []string{"s3:PutObject", "s3:DeleteObject"}, Resource: []string{"arn:aws:s3:::pvc-1/" + defaultMetadataName}},
+	}
+
+	if policy.Version != "2012-10-17" {
+		t.Errorf("bucketPolicy() version = %s", policy.Version)
+	}
+	if !reflect.DeepEqual(policy.Statement, want) {
+		t.Errorf("bucketPolicy() = %+v, want %+v", policy.Statement, want)
+	}
+}
+
+func Test_serviceAccountName(t *testing.T) {
+	tests := []struct {
+		bucketName string
+		want       string
+	}{
+		{bucketName: "pvc-0b7e0c58-3a4c-4a5e-9a0e-2c1f2f6c8d11", want: "pvc-0b7e0c58-3a4c-4a5e-9a0e-2c1f"},
+		{bucketName: "my.bucket", want: "my-bucket"},
+		{bucketName: "0-bucket", want: "csi-0-bucket"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.bucketName, func(t *testing.T) {
+			if got := serviceAccountName(tt.bucketName); got != tt.want {
+				t.Errorf("serviceAccountName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_minioCredentialsProvisioner(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{}
+	client := newFakeS3Client(t, fake)
+	client.cfg.ScopedCredentialsKey = "derive-the-secret-keys"
+	provisioner, err := newCredentialsProvisioner(scopedCredentialsMinio, client, DefaultDriverName, defaultMetadataName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := provisioner.create(ctx, "pvc-0b7e0c58-3a4c-4a5e-9a0e-2c1f2f6c8d11")
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	if creds.SecretAccessKey != "" {
+		t.Error("create() returned a secret key which would be stored in the metadata")
+	}
+	account, ok := fake.serviceAccounts[creds.AccessKeyID]
+	if !ok {
+		t.Fatalf("service account %s was not created", creds.AccessKeyID)
+	}
+	cfg, err := creds.config(client.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SecretAccessKey != account.SecretKey {
+		t.Error("config() does not derive the secret key of the service account")
+	}
+
+	// a retry after the metadata could not be written reuses the account
+	again, err := provisioner.create(ctx, "pvc-0b7e0c58-3a4c-4a5e-9a0e-2c1f2f6c8d11")
+	if err != nil {
+		t.Fatalf("create() retry error = %v", err)
+	}
+	if !reflect.DeepEqual(again, creds) || len(fake.serviceAccounts) != 1 {
+		t.Errorf("create() retry = %v with %d accounts, want %v with one account", again, len(fake.serviceAccounts), creds)
+	}
+
+	if err := provisioner.revoke(ctx, creds); err != nil {
+		t.Fatalf("revoke() error = %v", err)
+	}
+	if len(fake.serviceAccounts) != 0 {
+		t.Error("revoke() did not delete the service account")
+	}
+	if err := provisioner.revoke(ctx, creds); err != nil {
+		t.Errorf("revoke() of a deleted account error = %v", err)
+	}
+}
+
+func Test_scopedCredentialsOfVolume(t *testing.T) {
+	ctx := context.Background()
+	failMetadata := true
+	fake := &fakeS3{
+		fail: func(r *http.Request) string {
+			if failMetadata && r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/"+defaultMetadataName) {
+				return "AccessDenied"
+			}
+			return ""
+		},
+	}
+	secrets := startFakeS3(t, fake)
+	secrets["scopedCredentialsKey"] = "derive-the-secret-keys"
+	cs := newFakeControllerServer()
+	opts := &bucketOptions{FSPath: defaultFSPrefix, ScopedCredentials: scopedCredentialsMinio}
+
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, opts); err == nil {
+		t.Fatal("ensureBucketWithMetadata() succeeded without metadata")
+	}
+	if len(fake.serviceAccounts) != 0 {
+		t.Error("service account was not revoked after the metadata could not be written")
+	}
+
+	failMetadata = false
+	if err := cs.ensureBucketWithMetadata(ctx, "pvc-1", secrets, 1024, opts); err != nil {
+		t.Fatalf("ensureBucketWithMetadata() error = %v", err)
+	}
+	if len(fake.serviceAccounts) != 1 {
+		t.Fatalf("%d service accounts created, want one", len(fake.serviceAccounts))
+	}
+	for _, account := range fake.serviceAccounts {
+		if strings.Contains(string(fake.bucket("pvc-1").latest(defaultMetadataName).data), account.SecretKey) {
+			t.Error("secret key of the service account is stored in the metadata")
+		}
+	}
+
+	client, err := cs.clients.get(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.removeVolume(ctx, client, "pvc-1"); err != nil {
+		t.Fatalf("removeVolume() error = %v", err)
+	}
+	if len(fake.serviceAccounts) != 0 {
+		t.Error("service account was not revoked with the volume")
+	}
+}
@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+// nonBlockingGRPCServer is the csicommon.NonBlockingGRPCServer with additional interceptors,
+// csicommon only installs its logging interceptor.
+type nonBlockingGRPCServer struct {
+	interceptors []grpc.UnaryServerInterceptor
+
+	wg     sync.WaitGroup
+	server *grpc.Server
+}
+
+var _ csicommon.NonBlockingGRPCServer = &nonBlockingGRPCServer{}
+
+// newNonBlockingGRPCServer returns a server which runs the interceptors after the tracing and logging of the calls
+func newNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{
+		interceptors: append([]grpc.UnaryServerInterceptor{tracingInterceptor, loggingInterceptor}, interceptors...),
+	}
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	s.wg.Add(1)
+	go s.serve(endpoint, ids, cs, ns)
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+}
+
+func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	defer s.wg.Done()
+
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		klog.Fatal(err.Error())
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+		}
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		klog.Fatalf("Failed to listen: %v", err)
+	}
+
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(s.interceptors...))
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+
+	klog.InfoS("Listening for connections", "address", listener.Addr().String())
+	if err := s.server.Serve(listener); err != nil {
+		klog.ErrorS(err, "gRPC server stopped")
+	}
+}
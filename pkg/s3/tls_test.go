@@ -0,0 +1,112 @@
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func Test_tlsConfig(t *testing.T) {
+	cert, key := selfSignedCert(t)
+
+	tests := []struct {
+		name        string
+		cfg         *Config
+		wantNil     bool
+		wantRootCAs bool
+		wantCerts   int
+		wantErr     bool
+	}{
+		{
+			name:    "defaults",
+			cfg:     &Config{},
+			wantNil: true,
+		},
+		{
+			name:        "ca bundle",
+			cfg:         &Config{CABundle: cert},
+			wantRootCAs: true,
+		},
+		{
+			name:    "invalid ca bundle",
+			cfg:     &Config{CABundle: "not a certificate"},
+			wantErr: true,
+		},
+		{
+			name:      "client certificate",
+			cfg:       &Config{ClientCert: cert, ClientKey: key},
+			wantCerts: 1,
+		},
+		{
+			name:    "client certificate without key",
+			cfg:     &Config{ClientCert: cert},
+			wantErr: true,
+		},
+		{
+			name: "insecure",
+			cfg:  &Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.tlsConfig()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("tlsConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("tlsConfig() = %v, wantNil %v", got, tt.wantNil)
+				return
+			}
+			if got == nil {
+				return
+			}
+			if (got.RootCAs != nil) != tt.wantRootCAs {
+				t.Errorf("tlsConfig() RootCAs = %v, want %v", got.RootCAs != nil, tt.wantRootCAs)
+			}
+			if len(got.Certificates) != tt.wantCerts {
+				t.Errorf("tlsConfig() Certificates = %d, want %d", len(got.Certificates), tt.wantCerts)
+			}
+			if got.InsecureSkipVerify != tt.cfg.InsecureSkipVerify {
+				t.Errorf("tlsConfig() InsecureSkipVerify = %v, want %v", got.InsecureSkipVerify, tt.cfg.InsecureSkipVerify)
+			}
+		})
+	}
+}
+
+func selfSignedCert(t *testing.T) (string, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "s3.example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(key)
+}
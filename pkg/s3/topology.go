@@ -0,0 +1,239 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Volume context of volumes created at a site, the nodes mount them from its endpoint instead of the one of the secret
+const (
+	contextSiteEndpoint = "siteEndpoint"
+	contextSiteRegion   = "siteRegion"
+)
+
+// TopologyOptions configure the topology of the nodes and the sites volumes are created at
+type TopologyOptions struct {
+	// Segments are reported as topology of the node
+	Segments map[string]string `json:"segments,omitempty"`
+	// NodeLabels are the keys of the labels of the kubernetes node NodeID which are reported as topology of the node
+	NodeLabels []string `json:"nodeLabels,omitempty"`
+	// Sites are the S3 endpoints of the topology, volumes are created at the first site matching the accessibility requirements
+	Sites []TopologySite `json:"sites,omitempty"`
+}
+
+// TopologySite is an S3 endpoint which is accessible from the nodes in its segments
+type TopologySite struct {
+	Name     string            `json:"name"`
+	Segments map[string]string `json:"segments"`
+	// Endpoint and Region replace the ones of the secret for volumes created at the site
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+}
+
+// enabled returns true if the topology of the nodes or volumes is configured
+func (o TopologyOptions) enabled() bool {
+	return len(o.Segments) > 0 || len(o.NodeLabels) > 0 || len(o.Sites) > 0
+}
+
+func (o TopologyOptions) validate() error {
+	var errs []error
+	for key := range o.Segments {
+		errs = append(errs, validateSegmentKey(key))
+	}
+	for _, key := range o.NodeLabels {
+		errs = append(errs, validateSegmentKey(key))
+	}
+	names := map[string]bool{}
+	for _, site := range o.Sites {
+		if site.Name == "" || names[site.Name] {
+			errs = append(errs, fmt.Errorf("topology sites need a unique name, got %q", site.Name))
+		}
+		names[site.Name] = true
+		if len(site.Segments) == 0 {
+			errs = append(errs, fmt.Errorf("topology site %s has no segments", site.Name))
+		}
+		for key := range site.Segments {
+			errs = append(errs, validateSegmentKey(key))
+		}
+		if site.Endpoint == "" && site.Region == "" {
+			errs = append(errs, fmt.Errorf("topology site %s needs an endpoint or a region", site.Name))
+		}
+		if site.Endpoint != "" {
+			if _, err := endpointAddress(site.Endpoint); err != nil {
+				errs = append(errs, fmt.Errorf("topology site %s: %w", site.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateSegmentKey(key string) error {
+	if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+		return fmt.Errorf("invalid topology key %q: %s", key, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// ParseSegments parses key=value pairs separated by comma
+func ParseSegments(s string) (map[string]string, error) {
+	segments := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid topology segment %q, must be key=value", pair)
+		}
+		segments[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return segments, nil
+}
+
+// ParseList parses values separated by comma
+func ParseList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// selectSite returns the site of a new volume, the preferred topologies are considered before the requisite ones.
+// The first site is used if the CO has no requirements.
+func selectSite(sites []TopologySite, requirements *csi.TopologyRequirement) (*TopologySite, error) {
+	if len(requirements.GetPreferred()) == 0 && len(requirements.GetRequisite()) == 0 {
+		return &sites[0], nil
+	}
+	for _, topologies := range [][]*csi.Topology{requirements.GetPreferred(), requirements.GetRequisite()} {
+		for _, topology := range topologies {
+			for i := range sites {
+				if sites[i].accessibleFrom(topology.GetSegments()) {
+					return &sites[i], nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no site is accessible from the topologies %v", requirements.GetRequisite())
+}
+
+// accessibleFrom returns true if all segments of the site are part of the topology
+func (s *TopologySite) accessibleFrom(segments map[string]string) bool {
+	for key, value := range s.Segments {
+		if segments[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// secrets returns the secrets of a volume at the site
+func (s *TopologySite) secrets(secrets map[string]string) map[string]string {
+	return withSite(secrets, s.Endpoint, s.Region)
+}
+
+// volumeContext adds the endpoint of the site to the volume context
+func (s *TopologySite) volumeContext(volumeContext map[string]string) {
+	if s.Endpoint != "" {
+		volumeContext[contextSiteEndpoint] = s.Endpoint
+	}
+	if s.Region != "" {
+		volumeContext[contextSiteRegion] = s.Region
+	}
+}
+
+// volumeSecrets returns the secrets of a volume, its site replaces the endpoint of the secret
+func volumeSecrets(secrets map[string]string, volumeContext map[string]string) map[string]string {
+	return withSite(secrets, volumeContext[contextSiteEndpoint], volumeContext[contextSiteRegion])
+}
+
+func withSite(secrets map[string]string, endpoint, region string) map[string]string {
+	if endpoint == "" && region == "" {
+		return secrets
+	}
+	merged := make(map[string]string, len(secrets)+2)
+	for k, v := range secrets {
+		merged[k] = v
+	}
+	if endpoint != "" {
+		merged["endpoint"] = endpoint
+	} else {
+		// the endpoint of the secret is of another site, the AWS endpoint of the region is used
+		delete(merged, "endpoint")
+	}
+	if region != "" {
+		merged["region"] = region
+	}
+	return merged
+}
+
+// nodesClient is the part of the Kubernetes API used to read the topology of a node
+type nodesClient interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Node, error)
+}
+
+// nodeTopology returns the id and topology reported by a node
+type nodeTopology struct {
+	nodeID   string
+	segments map[string]string
+	labels   []string
+	nodes    nodesClient
+}
+
+func newNodeTopology(opts TopologyOptions, nodeID string) (*nodeTopology, error) {
+	t := &nodeTopology{nodeID: nodeID, segments: opts.Segments, labels: opts.NodeLabels}
+	if len(opts.NodeLabels) == 0 {
+		return t, nil
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("topology from node labels requires to run in a cluster: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	t.nodes = clientset.CoreV1().Nodes()
+	return t, nil
+}
+
+// get returns the configured segments and the labels of the node, labels missing on the node are an error
+func (t *nodeTopology) get(ctx context.Context) (*csi.Topology, error) {
+	segments := map[string]string{}
+	for k, v := range t.segments {
+		segments[k] = v
+	}
+	if len(t.labels) > 0 {
+		node, err := t.nodes.Get(ctx, t.nodeID, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get node %s: %w", t.nodeID, err)
+		}
+		var missing []string
+		for _, key := range t.labels {
+			value, ok := node.Labels[key]
+			if !ok {
+				missing = append(missing, key)
+				continue
+			}
+			segments[key] = value
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("node %s has no labels %s", t.nodeID, strings.Join(missing, ", "))
+		}
+	}
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	return &csi.Topology{Segments: segments}, nil
+}
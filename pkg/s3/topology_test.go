@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const zoneKey = "topology.kubernetes.io/zone"
+
+func Test_selectSite(t *testing.T) {
+	sites := []TopologySite{
+		{Name: "dc1", Segments: map[string]string{zoneKey: "dc1"}, Endpoint: "https://s3.dc1.example.com"},
+		{Name: "dc2", Segments: map[string]string{zoneKey: "dc2"}, Endpoint: "https://s3.dc2.example.com"},
+	}
+	zone := func(z string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{zoneKey: z, "kubernetes.io/hostname": "node-" + z}}
+	}
+	tests := []struct {
+		name         string
+		requirements *csi.TopologyRequirement
+		want         string
+		wantErr      bool
+	}{
+		{name: "no requirements", want: "dc1"},
+		{
+			name:         "requisite",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("dc3"), zone("dc2")}},
+			want:         "dc2",
+		},
+		{
+			name: "preferred before requisite",
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zone("dc1"), zone("dc2")},
+				Preferred: []*csi.Topology{zone("dc2"), zone("dc1")},
+			},
+			want: "dc2",
+		},
+		{
+			name:         "no matching site",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("dc3")}},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			site, err := selectSite(sites, tt.requirements)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectSite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && site.Name != tt.want {
+				t.Errorf("selectSite() = %s, want %s", site.Name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_volumeSecrets(t *testing.T) {
+	secrets := map[string]string{"accessKeyID": "key", "endpoint": "https://s3.dc1.example.com"}
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		want          map[string]string
+	}{
+		{name: "without site", want: secrets},
+		{
+			name:          "endpoint of the site",
+			volumeContext: map[string]string{contextSiteEndpoint: "https://s3.dc2.example.com"},
+			want:          map[string]string{"accessKeyID": "key", "endpoint": "https://s3.dc2.example.com"},
+		},
+		{
+			name:          "region of the site",
+			volumeContext: map[string]string{contextSiteRegion: "eu-central-1"},
+			want:          map[string]string{"accessKeyID": "key", "region": "eu-central-1"},
+		},
+	}
+	for _, tt := range tests {
+		if got := volumeSecrets(secrets, tt.volumeContext); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: volumeSecrets() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if secrets["endpoint"] != "https://s3.dc1.example.com" {
+		t.Error("volumeSecrets() modified the secrets")
+	}
+}
+
+func Test_nodeTopology(t *testing.T) {
+	nodes := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{zoneKey: "dc1"}},
+	}).CoreV1().Nodes()
+	tests := []struct {
+		name     string
+		topology *nodeTopology
+		want     *csi.Topology
+		wantErr  bool
+	}{
+		{name: "none", topology: &nodeTopology{nodeID: "node-1"}},
+		{
+			name:     "segments and labels",
+			topology: &nodeTopology{nodeID: "node-1", segments: map[string]string{"example.com/rack": "r1"}, labels: []string{zoneKey}, nodes: nodes},
+			want:     &csi.Topology{Segments: map[string]string{"example.com/rack": "r1", zoneKey: "dc1"}},
+		},
+		{
+			name:     "missing label",
+			topology: &nodeTopology{nodeID: "node-1", labels: []string{"example.com/rack"}, nodes: nodes},
+			wantErr:  true,
+		},
+		{
+			name:     "missing node",
+			topology: &nodeTopology{nodeID: "node-2", labels: []string{zoneKey}, nodes: nodes},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.topology.get(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/metal-stack/v"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "github.com/majst01/csi-driver-s3/pkg/s3"
+
+// tracer creates the spans of the driver, they are dropped until setupTracing installs an exporter
+var tracer = otel.Tracer(tracerName)
+
+// TracingOptions configure the export of traces to an OpenTelemetry collector over OTLP/gRPC
+type TracingOptions struct {
+	// Endpoint is the host:port of the collector, traces are not exported if empty
+	Endpoint string `json:"endpoint,omitempty"`
+	// Insecure connects to the collector without TLS
+	Insecure bool `json:"insecure,omitempty"`
+	// SampleRatio is the fraction of the calls without a sampled parent which are traced
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+// DefaultTracingOptions traces every call once an endpoint is configured
+var DefaultTracingOptions = TracingOptions{SampleRatio: 1}
+
+func (o TracingOptions) validate() error {
+	var errs []error
+	if o.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(o.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tracing endpoint %q: %w", o.Endpoint, err))
+		}
+	}
+	if o.SampleRatio < 0 || o.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("invalid tracing sampleRatio %v, must be between 0 and 1", o.SampleRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// setupTracing exports the spans of the driver to the collector of opts, the returned function flushes and stops the export
+func setupTracing(opts TracingOptions, driverName, nodeID string) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporterOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracegrpc.WithInsecure())
+	}
+	// the exporter connects lazily, an unreachable collector does not prevent the driver from starting
+	exporter, err := otlptracegrpc.New(context.Background(), exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(driverName),
+			semconv.ServiceVersion(v.Version),
+			semconv.ServiceInstanceID(nodeID),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// tracingInterceptor starts a span for every CSI call, it continues the trace of the caller if it sends a traceparent
+func tracingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if md, ok := grpcmetadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	values := requestValues(req)
+	attrs := []attribute.KeyValue{
+		semconv.RPCSystemGRPC,
+		attribute.String("rpc.method", info.FullMethod),
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		attrs = append(attrs, attribute.String("csi."+values[i].(string), values[i+1].(string)))
+	}
+	ctx, span := tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	endSpan(span, err)
+	return resp, err
+}
+
+// endSpan records err in span, the span must still be ended by the caller
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+}
+
+// traceValues returns the trace and span id of ctx as key/value pairs for the logs
+func traceValues(ctx context.Context) []any {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []any{"traceID", sc.TraceID().String(), "spanID", sc.SpanID().String()}
+}
+
+// metadataCarrier reads the propagated trace from the metadata of a gRPC call
+type metadataCarrier grpcmetadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := grpcmetadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	grpcmetadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
+)
+
+// testCollector is an OTLP collector which keeps all received spans
+type testCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *testCollector) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			c.spans = append(c.spans, ss.GetSpans()...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func Test_tracing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &testCollector{}
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, collector)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	stopTracing, err := setupTracing(TracingOptions{Endpoint: listener.Addr().String(), Insecure: true, SampleRatio: 1}, DefaultDriverName, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller continues its trace with a traceparent
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := grpcmetadata.NewIncomingContext(context.Background(), grpcmetadata.Pairs("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01"))
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+	_, err = tracingInterceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"},
+		func(ctx context.Context, req any) (any, error) {
+			client := &s3Client{cfg: &Config{OperationTimeout: time.Second}}
+			if err := client.do(ctx, "MakeBucket", "create bucket", func(ctx context.Context) error { return nil }); err != nil {
+				return nil, err
+			}
+			return nil, fuseMount(ctx, "false", nil, nil)
+		})
+	if err == nil {
+		t.Fatal("expected error of the mounter")
+	}
+	if err := stopTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	spans := map[string]*tracepb.Span{}
+	for _, s := range collector.spans {
+		spans[s.GetName()] = s
+	}
+	call := spans["/csi.v1.Controller/CreateVolume"]
+	if call == nil {
+		t.Fatalf("no span of the CSI call in %v", collector.spans)
+	}
+	if got := hex.EncodeToString(call.GetTraceId()); got != traceID {
+		t.Errorf("trace id = %s, want the trace of the caller %s", got, traceID)
+	}
+	if call.GetStatus().GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("status of the CSI call = %v, want error", call.GetStatus())
+	}
+	for _, name := range []string{"MakeBucket", "mount false"} {
+		child := spans[name]
+		if child == nil {
+			t.Errorf("no span %s", name)
+			continue
+		}
+		if !bytes.Equal(child.GetParentSpanId(), call.GetSpanId()) {
+			t.Errorf("span %s is no child of the CSI call", name)
+		}
+	}
+	if mount := spans["mount false"]; mount != nil && mount.GetStatus().GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("error of the mounter not recorded")
+	}
+}